@@ -0,0 +1,240 @@
+package autoscaler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type CAOpts struct {
+	// Act as an ssh certificate authority. The servers get a host certificate and trust the
+	// CA for user certificates, instead of getting the authorized key of the autoscaler
+	Enabled bool `yaml:"enabled"`
+	// How long the user certificates the autoscaler connects with are valid, defaults to 1h.
+	// A new certificate is issued when half of the time has passed
+	UserCertValidity time.Duration `yaml:"user_cert_validity"`
+	// How long the host certificates of the servers are valid, defaults to 24h. A server gets
+	// a new certificate, bound to its address, when it is ready and when half of the time has
+	// passed
+	HostCertValidity time.Duration `yaml:"host_cert_validity"`
+	// Command run on the servers to install a new host certificate, read from stdin, and
+	// reload sshd. Defaults to sudo -n /usr/local/sbin/autoscaler-renew-host-cert, which
+	// the default cloud-init file installs
+	RenewCommand string `yaml:"renew_command"`
+}
+
+// How long to wait for the renew command to finish
+const hostCertRenewTimeout = 30 * time.Second
+
+// How long to wait before trying again if renewing a host certificate fails
+const hostCertRenewRetry = time.Minute
+
+// Time for creating a server and installing a host certificate bound to its address, on top
+// of the readiness probes, before the certificate in the cloud-init file expires
+const bootstrapCertMargin = 5 * time.Minute
+
+// Clients and servers can disagree a bit about the time, certificates are valid from a bit
+// before they are issued
+const certClockSkew = 5 * time.Minute
+
+// A tiny ssh certificate authority, signing the host keys of the servers and the keys the
+// autoscaler authenticates with.
+type sshCA struct {
+	signer           ssh.Signer
+	userCertValidity time.Duration
+	hostCertValidity time.Duration
+	renewCommand     string
+	// How long the host certificates in the cloud-init files are valid
+	bootstrapCertValidity time.Duration
+	// The host key shared by the servers
+	hostKey ssh.PublicKey
+}
+
+// Creates the CA, the key is stored as ca_key in stateDir if it is set.
+func newSSHCA(stateDir string, opts SSHOpts) (*sshCA, error) {
+	key, err := loadOrGeneratePrivateKey(stateDir, "ca_key", opts.keyType())
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	validity := opts.CA.UserCertValidity
+	if validity == 0 {
+		validity = time.Hour
+	}
+	hostValidity := opts.CA.HostCertValidity
+	if hostValidity == 0 {
+		hostValidity = 24 * time.Hour
+	}
+	renewCommand := opts.CA.RenewCommand
+	if renewCommand == "" {
+		renewCommand = "sudo -n /usr/local/sbin/autoscaler-renew-host-cert"
+	}
+
+	return &sshCA{
+		signer:           signer,
+		userCertValidity: validity,
+		hostCertValidity: hostValidity,
+		renewCommand:     renewCommand,
+	}, nil
+}
+
+func (ca *sshCA) publicKey() ssh.PublicKey {
+	return ca.signer.PublicKey()
+}
+
+func (ca *sshCA) sign(key ssh.PublicKey, certType uint32, principals []string, validBefore uint64) (*ssh.Certificate, error) {
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, err
+	}
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        certType,
+		KeyId:           "autoscaler-proxy",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-certClockSkew).Unix()),
+		ValidBefore:     validBefore,
+	}
+	if certType == ssh.UserCert {
+		cert.Permissions.Extensions = map[string]string{"permit-port-forwarding": ""}
+	}
+
+	return cert, cert.SignCert(rand.Reader, ca.signer)
+}
+
+// Signs the host key of the servers for the given principals (addresses)
+func (ca *sshCA) signHostKey(principals []string) (*ssh.Certificate, error) {
+	validBefore := uint64(time.Now().Add(ca.hostCertValidity).Unix())
+	return ca.sign(ca.hostKey, ssh.HostCert, principals, validBefore)
+}
+
+// Signs the host certificate for the cloud-init file of a server. It has no principals, as
+// the address of the server isn't known before it is created, so it is only valid until the
+// server has had time to become ready and get a certificate bound to its address.
+func (ca *sshCA) signBootstrapHostKey() (*ssh.Certificate, error) {
+	validBefore := uint64(time.Now().Add(ca.bootstrapCertValidity).Unix())
+	return ca.sign(ca.hostKey, ssh.HostCert, nil, validBefore)
+}
+
+// Signs a short lived certificate for user
+func (ca *sshCA) signUserKey(key ssh.PublicKey, user string) (*ssh.Certificate, error) {
+	validBefore := uint64(time.Now().Add(ca.userCertValidity).Unix())
+	return ca.sign(key, ssh.UserCert, []string{user}, validBefore)
+}
+
+// Accepts hosts presenting a certificate signed by the CA
+func (ca *sshCA) hostKeyCallback() ssh.HostKeyCallback {
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return bytes.Equal(auth.Marshal(), ca.publicKey().Marshal())
+		},
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if _, ok := key.(*ssh.Certificate); !ok {
+			return fmt.Errorf("Host %s didn't present a certificate", hostname)
+		}
+		return checker.CheckHostKey(hostname, remote, key)
+	}
+}
+
+// Authenticates with a user certificate for signer, issuing a new certificate when the
+// current one is about to expire.
+type certSigner struct {
+	ca     *sshCA
+	signer ssh.Signer
+	user   string
+
+	mu      sync.Mutex
+	cert    ssh.Signer
+	renewAt time.Time
+}
+
+func (c *certSigner) Signers() ([]ssh.Signer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert == nil || time.Now().After(c.renewAt) {
+		log.Debug("Issuing new user certificate")
+		cert, err := c.ca.signUserKey(c.signer.PublicKey(), c.user)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.NewCertSigner(cert, c.signer)
+		if err != nil {
+			return nil, err
+		}
+		c.cert = signer
+		c.renewAt = time.Now().Add(c.ca.userCertValidity / 2)
+	}
+
+	return []ssh.Signer{c.cert}, nil
+}
+
+// Issues a new host certificate for s, bound to its address, and installs it on the server
+// over the existing connection with the renew command.
+func (as *Autoscaler) renewHostCert(s *poolServer) error {
+	ca := as.sshClient.ca
+	log := log.WithField("server", s.server.Name)
+
+	host, _, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		return err
+	}
+	cert, err := ca.signHostKey([]string{host})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hostCertRenewTimeout)
+	defer cancel()
+
+	if err := s.ssh.Run(ctx, ca.renewCommand, bytes.NewReader(ssh.MarshalAuthorizedKey(cert))); err != nil {
+		log.WithError(err).Warn("Failed to renew host certificate")
+		as.mu.Lock()
+		s.hostCertRenewAt = time.Now().Add(hostCertRenewRetry)
+		as.mu.Unlock()
+		return err
+	}
+
+	log.Debug("Renewed host certificate")
+	as.mu.Lock()
+	s.hostCertRenewAt = time.Now().Add(ca.hostCertValidity / 2)
+	as.mu.Unlock()
+
+	return nil
+}
+
+// Renews the host certificates that are due in the background, if in CA mode.
+func (as *Autoscaler) renewHostCerts() {
+	if as.sshClient.ca == nil {
+		return
+	}
+
+	as.mu.Lock()
+	due := []*poolServer{}
+	for _, s := range healthyServers(as.servers) {
+		if time.Now().After(s.hostCertRenewAt) {
+			// Not picked again while it is being renewed
+			s.hostCertRenewAt = time.Now().Add(hostCertRenewTimeout)
+			due = append(due, s)
+		}
+	}
+	as.mu.Unlock()
+
+	for _, s := range due {
+		go as.renewHostCert(s)
+	}
+}
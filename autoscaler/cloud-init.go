@@ -2,6 +2,7 @@ package autoscaler
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/JonasBak/autoscaler-proxy/utils"
 	"github.com/getsops/sops/v3/decrypt"
@@ -9,31 +10,57 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-func CreateCloudInitFile(template map[string]interface{}, opts AutoscalerOpts, serverKeyBytes []byte, authorizedKey ssh.PublicKey) (string, error) {
-	serverKey, err := ssh.ParsePrivateKey(serverKeyBytes)
-	if err != nil {
-		return "", err
-	}
-	pubkeyBytes := ssh.MarshalAuthorizedKey(serverKey.PublicKey())
-	authorizedKeyBytes := ssh.MarshalAuthorizedKey(authorizedKey)
-
-	variables := opts.CloudInitVariables
-	if variables == nil {
-		variables = make(map[string]string)
+// Reads the cloud-init variables, the ones decrypted from cloud_init_variables_from on top of
+// the ones in the config. Done once, every cloud-init file gets a copy.
+func loadCloudInitVariables(opts AutoscalerOpts) (map[string]string, error) {
+	variables := make(map[string]string)
+	for k, v := range opts.CloudInitVariables {
+		variables[k] = v
 	}
 
 	if opts.CloudInitVariablesFrom != "" {
 		yml, err := decrypt.File(opts.CloudInitVariablesFrom, "yaml")
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		if err := yaml.Unmarshal(yml, &variables); err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 
-	variables["SERVER_RSA_PRIVATE"] = string(serverKeyBytes)
-	variables["SERVER_RSA_PUBLIC"] = string(pubkeyBytes)
+	return variables, nil
+}
+
+// Builds the cloud-init file from the template and a copy of configured, with the keys and
+// certificates of sshClient available as variables. In CA mode a new host certificate is
+// issued every time.
+func CreateCloudInitFile(template map[string]interface{}, configured map[string]string, keyType string, sshClient SSHClient) (string, error) {
+	authorizedKeyBytes := ssh.MarshalAuthorizedKey(sshClient.publicKey)
+
+	variables := make(map[string]string, len(configured))
+	for k, v := range configured {
+		variables[k] = v
+	}
+
+	keyType = strings.ToUpper(keyType)
+	if sshClient.remoteKey != nil {
+		serverKey, err := ssh.ParsePrivateKey(sshClient.remoteKey)
+		if err != nil {
+			return "", err
+		}
+		pubkeyBytes := ssh.MarshalAuthorizedKey(serverKey.PublicKey())
+
+		variables[fmt.Sprintf("SERVER_%s_PRIVATE", keyType)] = string(sshClient.remoteKey)
+		variables[fmt.Sprintf("SERVER_%s_PUBLIC", keyType)] = string(pubkeyBytes)
+	}
+	if sshClient.ca != nil {
+		cert, err := sshClient.ca.signBootstrapHostKey()
+		if err != nil {
+			return "", err
+		}
+		variables[fmt.Sprintf("SERVER_%s_CERTIFICATE", keyType)] = string(ssh.MarshalAuthorizedKey(cert))
+		variables["SSH_CA_PUBLIC"] = string(ssh.MarshalAuthorizedKey(sshClient.ca.publicKey()))
+	}
 	variables["AUTOSCALER_AUTHORIZED_KEY"] = string(authorizedKeyBytes)
 
 	config := utils.BuildTemplate(utils.WithEnvMap(utils.TemplateMap(variables)), template)
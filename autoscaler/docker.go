@@ -0,0 +1,105 @@
+package autoscaler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type DockerKeepaliveOpts struct {
+	// Path of the docker socket on the server, defaults to /var/run/docker.sock
+	Socket string `yaml:"socket"`
+	// Only containers matching these filters keep the server running, same format as
+	// `docker ps --filter`, for example {"label": ["keepalive=true"]}
+	Filters map[string][]string `yaml:"filters"`
+	// How long to wait for the docker api before giving up, and letting the server be scaled
+	// down. Defaults to 10s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (o DockerKeepaliveOpts) timeout() time.Duration {
+	if o.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return o.Timeout
+}
+
+// Lists the running containers matching the filters from opts, using the docker api on the
+// server sshConn is connected to. Gives up after the timeout from opts.
+func runningContainers(ctx context.Context, sshConn *sshConnPool, opts DockerKeepaliveOpts) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout())
+	defer cancel()
+
+	socket := opts.Socket
+	if socket == "" {
+		socket = "/var/run/docker.sock"
+	}
+
+	client := http.Client{
+		Timeout: opts.timeout(),
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return sshConn.Dial(ctx, "unix", socket)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	query := url.Values{}
+	if len(opts.Filters) > 0 {
+		filters, err := json.Marshal(opts.Filters)
+		if err != nil {
+			return 0, err
+		}
+		query.Set("filters", string(filters))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://docker/containers/json?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Docker api responded with %s", resp.Status)
+	}
+
+	containers := []json.RawMessage{}
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return 0, err
+	}
+
+	return len(containers), nil
+}
+
+// Checks if there are containers running on the server that should keep it from being
+// scaled down. If the docker api can't be reached, or doesn't respond in time, the server
+// isn't kept alive.
+func (as *Autoscaler) keptAliveByDocker(ctx context.Context, s *poolServer) bool {
+	if as.dockerKeepalive == nil {
+		return false
+	}
+
+	log := log.WithField("server", s.server.Name)
+
+	n, err := runningContainers(ctx, s.ssh, *as.dockerKeepalive)
+	if err != nil {
+		log.WithError(err).Warn("Failed to list docker containers")
+		return false
+	}
+
+	if n > 0 {
+		log.WithField("containers", n).Info("Containers are running, postponing scaledown")
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,67 @@
+package autoscaler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Label put on every server created, with the id of the autoscaler instance creating it
+const instanceLabel = "autoscaler-proxy/instance"
+
+type GCOpts struct {
+	// How often to look for orphaned servers, 0 disables garbage collection
+	Interval time.Duration `yaml:"interval"`
+	// Servers older than this are deleted even if they are in use, 0 disables the limit
+	MaxLifetime time.Duration `yaml:"max_lifetime"`
+}
+
+// Deletes servers that are labeled by an autoscaler and named with this autoscaler's server
+// name prefix, that either aren't in the pool (typically left behind by a crashed instance)
+// or have been running for longer than the max lifetime. This version of the function should
+// only be called from the goroutine running Start().
+func (as *Autoscaler) collectGarbage(ctx context.Context) error {
+	log.Debug("Looking for orphaned servers")
+
+	servers, err := as.provider.ListServers(ctx, map[string]string{instanceLabel: ""})
+	if err != nil {
+		return err
+	}
+
+	as.mu.Lock()
+	owned := make(map[string]*poolServer)
+	for _, s := range as.servers {
+		owned[s.server.ID] = s
+	}
+	as.mu.Unlock()
+
+	errs := []error{}
+	for _, server := range servers {
+		if !strings.HasPrefix(server.Name, as.serverNamePrefix+"-") || as.creating[server.Name] {
+			continue
+		}
+
+		log := log.WithField("server", server.Name).WithField("instance", server.Labels[instanceLabel])
+
+		expired := as.gc.MaxLifetime > 0 && time.Since(server.Created) > as.gc.MaxLifetime
+
+		if s, ok := owned[server.ID]; ok {
+			if expired {
+				log.Warn("Server has exceeded max lifetime, deleting")
+				if err := as.deleteServer(s); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			continue
+		}
+
+		log.Warn("Deleting orphaned server")
+		if err := as.provider.DeleteServer(ctx, server); err != nil {
+			log.WithError(err).Error("Failed to delete orphaned server")
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
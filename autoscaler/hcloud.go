@@ -0,0 +1,202 @@
+package autoscaler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+type hcloudProvider struct {
+	client     *hcloud.Client
+	serverType *hcloud.ServerType
+	image      *hcloud.Image
+	location   *hcloud.Location
+	sshPort    string
+	// Which address of the servers to connect to, ipv4, ipv6 or private
+	addressFamily string
+	// Network the servers are attached to, nil if none
+	network *hcloud.Network
+}
+
+func newHCloudProvider(opts AutoscalerOpts) *hcloudProvider {
+	client := hcloud.NewClient(hcloud.WithToken(opts.HCloudToken))
+
+	serverType, _, err := client.ServerType.GetByName(context.Background(), opts.ServerType)
+	if err != nil {
+		log.WithError(err).WithField("server_type", opts.ServerType).Fatal("Failed to fetch hetzner server type")
+	}
+
+	image, _, err := client.Image.GetByName(context.Background(), opts.ServerImage)
+	if err != nil {
+		log.WithError(err).WithField("server_image", opts.ServerImage).Fatal("Failed to fetch hetzner server image")
+	}
+
+	var location *hcloud.Location = nil
+	if opts.ServerLocation != "" {
+		l, _, err := client.Location.GetByName(context.Background(), opts.ServerLocation)
+		if err != nil {
+			log.WithError(err).WithField("server_location", opts.ServerLocation).Fatal("Failed to fetch hetzner server location")
+		}
+		location = l
+	}
+
+	addressFamily := opts.AddressFamily
+	if addressFamily == "" {
+		addressFamily = "ipv4"
+	}
+	if addressFamily != "ipv4" && addressFamily != "ipv6" && addressFamily != "private" {
+		log.WithField("address_family", opts.AddressFamily).Fatal("Unknown address family")
+	}
+
+	var network *hcloud.Network = nil
+	if opts.Network != "" {
+		n, _, err := client.Network.Get(context.Background(), opts.Network)
+		if err != nil || n == nil {
+			log.WithError(err).WithField("network", opts.Network).Fatal("Failed to fetch hetzner network")
+		}
+		network = n
+	} else if addressFamily == "private" {
+		log.Fatal("address_family private requires a network")
+	}
+
+	sshPort := 22
+	if opts.SSH.Port != 0 {
+		sshPort = opts.SSH.Port
+	}
+
+	return &hcloudProvider{
+		client:     client,
+		serverType: serverType,
+		image:      image,
+		location:   location,
+		sshPort:    strconv.Itoa(sshPort),
+
+		addressFamily: addressFamily,
+		network:       network,
+	}
+}
+
+func (p *hcloudProvider) CreateServer(ctx context.Context, opts ServerCreateOpts) (*Server, error) {
+	createOpts := hcloud.ServerCreateOpts{
+		Name:       opts.Name,
+		ServerType: p.serverType,
+		Image:      p.image,
+		Location:   p.location,
+		Labels:     opts.Labels,
+
+		UserData: opts.UserData,
+	}
+	if p.network != nil {
+		createOpts.Networks = []*hcloud.Network{p.network}
+	}
+	// Servers without public ipv4 addresses are cheaper
+	switch p.addressFamily {
+	case "ipv6":
+		createOpts.PublicNet = &hcloud.ServerCreatePublicNet{EnableIPv4: false, EnableIPv6: true}
+	case "private":
+		createOpts.PublicNet = &hcloud.ServerCreatePublicNet{EnableIPv4: false, EnableIPv6: false}
+	}
+
+	result, _, err := p.client.Server.Create(ctx, createOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Waiting for server to start")
+	_, c := p.client.Action.WatchOverallProgress(ctx, append([]*hcloud.Action{result.Action}, result.NextActions...))
+
+	if err := <-c; err != nil {
+		return nil, err
+	}
+
+	if p.network == nil {
+		return fromHCloudServer(result.Server), nil
+	}
+
+	// The private address isn't known before the server is attached to the network
+	server, _, err := p.client.Server.GetByID(ctx, result.Server.ID)
+	if err != nil {
+		return nil, err
+	}
+	if server == nil {
+		return nil, fmt.Errorf("Server %d disappeared after being created", result.Server.ID)
+	}
+
+	return fromHCloudServer(server), nil
+}
+
+func (p *hcloudProvider) DeleteServer(ctx context.Context, server *Server) error {
+	_, err := p.client.Server.Delete(ctx, server.Raw.(*hcloud.Server))
+	return err
+}
+
+func (p *hcloudProvider) ListServers(ctx context.Context, labels map[string]string) ([]*Server, error) {
+	selector := []string{}
+	for k, v := range labels {
+		if v == "" {
+			selector = append(selector, k)
+		} else {
+			selector = append(selector, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+
+	servers, err := p.client.Server.AllWithOpts(ctx, hcloud.ServerListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: strings.Join(selector, ",")},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Server, len(servers))
+	for i, s := range servers {
+		result[i] = fromHCloudServer(s)
+	}
+
+	return result, nil
+}
+
+func (p *hcloudProvider) Address(server *Server) (string, error) {
+	s := server.Raw.(*hcloud.Server)
+
+	var ip net.IP
+	switch p.addressFamily {
+	case "ipv4":
+		if s.PublicNet.IPv4.IsUnspecified() {
+			return "", fmt.Errorf("Server has no public ipv4 address")
+		}
+		ip = s.PublicNet.IPv4.IP
+	case "ipv6":
+		if s.PublicNet.IPv6.IsUnspecified() {
+			return "", fmt.Errorf("Server has no public ipv6 address")
+		}
+		// The server gets a /64 network, and uses the first address in it
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, s.PublicNet.IPv6.IP.To16())
+		ip[net.IPv6len-1] |= 1
+	case "private":
+		for _, n := range s.PrivateNet {
+			if n.Network != nil && n.Network.ID == p.network.ID {
+				ip = n.IP
+			}
+		}
+		if ip == nil {
+			return "", fmt.Errorf("Server has no address in network %s", p.network.Name)
+		}
+	}
+
+	return net.JoinHostPort(ip.String(), p.sshPort), nil
+}
+
+func fromHCloudServer(s *hcloud.Server) *Server {
+	return &Server{
+		ID:      strconv.Itoa(s.ID),
+		Name:    s.Name,
+		Created: s.Created,
+		Labels:  s.Labels,
+		Raw:     s,
+	}
+}
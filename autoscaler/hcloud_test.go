@@ -0,0 +1,47 @@
+package autoscaler
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+func TestHCloudAddress(t *testing.T) {
+	network := &hcloud.Network{ID: 7, Name: "internal"}
+	server := &Server{Raw: &hcloud.Server{
+		PublicNet: hcloud.ServerPublicNet{
+			IPv4: hcloud.ServerPublicNetIPv4{IP: net.ParseIP("192.0.2.10")},
+			IPv6: hcloud.ServerPublicNetIPv6{IP: net.ParseIP("2001:db8:1:2::")},
+		},
+		PrivateNet: []hcloud.ServerPrivateNet{
+			{Network: &hcloud.Network{ID: 3}, IP: net.ParseIP("10.1.0.2")},
+			{Network: network, IP: net.ParseIP("10.0.0.2")},
+		},
+	}}
+
+	for addressFamily, expected := range map[string]string{
+		"ipv4":    "192.0.2.10:2222",
+		"ipv6":    "[2001:db8:1:2::1]:2222",
+		"private": "10.0.0.2:2222",
+	} {
+		p := &hcloudProvider{sshPort: "2222", addressFamily: addressFamily, network: network}
+		addr, err := p.Address(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != expected {
+			t.Errorf("Expected %s address %s, got %s", addressFamily, expected, addr)
+		}
+	}
+
+	ipv6Only := &Server{Raw: &hcloud.Server{
+		PublicNet: hcloud.ServerPublicNet{
+			IPv6: hcloud.ServerPublicNetIPv6{IP: net.ParseIP("2001:db8:1:2::")},
+		},
+	}}
+	p := &hcloudProvider{sshPort: "22", addressFamily: "ipv4"}
+	if _, err := p.Address(ipv6Only); err == nil {
+		t.Error("Expected an error for a server without an ipv4 address")
+	}
+}
@@ -0,0 +1,185 @@
+package autoscaler
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type JumpHostOpts struct {
+	// Address (host:port) of the jump host, the servers are connected to directly if empty
+	Addr string `yaml:"addr"`
+	// User on the jump host, defaults to the user on the servers
+	User string `yaml:"user"`
+	// Public key (authorized_keys format) the jump host must present
+	HostKey string `yaml:"host_key"`
+	// Path to a known_hosts file used to verify the jump host
+	KnownHosts string `yaml:"known_hosts"`
+}
+
+// How long connecting to the jump host can take, connections are shared so it isn't tied to
+// the timeout of any dial
+const jumpHostConnectTimeout = 30 * time.Second
+
+// An ssh server the connections to the servers go through, like ProxyJump. One connection
+// to the jump host is shared, and replaced when it breaks.
+type jumpHost struct {
+	addr   string
+	config ssh.ClientConfig
+
+	mu sync.Mutex
+	// The shared connection, nil if there is none
+	conn *jumpConn
+}
+
+// A connection to the jump host, the ones dialing through it wait for ready
+type jumpConn struct {
+	// Set before ready is closed, nil if connecting failed
+	client *ssh.Client
+	// Set before ready is closed if connecting failed
+	err error
+	// Closed when the connection is established, or failed to be
+	ready chan struct{}
+}
+
+func newJumpHost(opts JumpHostOpts, user string, signers []ssh.Signer) (*jumpHost, error) {
+	if opts.HostKey == "" && opts.KnownHosts == "" {
+		return nil, fmt.Errorf("The jump host needs either host_key or known_hosts")
+	}
+	hostKeyCallback, hostKeyAlgorithms, err := pinnedHostKey(opts.HostKey, opts.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.User != "" {
+		user = opts.User
+	}
+
+	return &jumpHost{
+		addr: opts.Addr,
+		config: ssh.ClientConfig{
+			User: user,
+			Auth: []ssh.AuthMethod{
+				ssh.PublicKeys(signers...),
+			},
+			HostKeyCallback:   hostKeyCallback,
+			HostKeyAlgorithms: hostKeyAlgorithms,
+		},
+	}, nil
+}
+
+// Returns the connection to the jump host, connecting if there is none. Gives up waiting for
+// the connection after timeout if it isn't 0.
+func (j *jumpHost) connect(timeout time.Duration) (*ssh.Client, error) {
+	j.mu.Lock()
+	conn := j.conn
+	if conn == nil {
+		conn = &jumpConn{ready: make(chan struct{})}
+		j.conn = conn
+		go j.establish(conn)
+	}
+	j.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-conn.ready:
+	case <-expired:
+		return nil, fmt.Errorf("Timed out connecting to jump host %s", j.addr)
+	}
+	if conn.err != nil {
+		return nil, conn.err
+	}
+	return conn.client, nil
+}
+
+// Connects to the jump host, and forgets conn when it fails or breaks so that the next
+// dial connects again
+func (j *jumpHost) establish(conn *jumpConn) {
+	log := log.WithField("jump_host", j.addr)
+
+	log.Debug("Connecting to jump host")
+
+	forget := func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if j.conn == conn {
+			j.conn = nil
+		}
+	}
+
+	client, err := j.dialSSH()
+	if err != nil {
+		conn.err = err
+		forget()
+		close(conn.ready)
+		return
+	}
+	conn.client = client
+	close(conn.ready)
+
+	err = client.Wait()
+	log.WithError(err).Debug("Connection to jump host closed")
+	forget()
+}
+
+// Connects to the jump host, giving up after jumpHostConnectTimeout, also if the handshake
+// hangs
+func (j *jumpHost) dialSSH() (*ssh.Client, error) {
+	conn, err := net.DialTimeout("tcp", j.addr, jumpHostConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(jumpHostConnectTimeout))
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, j.addr, &j.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// Dials addr from the jump host, giving up after timeout if it isn't 0
+func (j *jumpHost) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	client, err := j.connect(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout == 0 {
+		return client.Dial("tcp", addr)
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	c := make(chan dialResult, 1)
+	go func() {
+		conn, err := client.Dial("tcp", addr)
+		c <- dialResult{conn, err}
+	}()
+
+	select {
+	case r := <-c:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-c; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("Timed out dialing %s through jump host", addr)
+	}
+}
@@ -2,13 +2,15 @@ package autoscaler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/JonasBak/autoscaler-proxy/metrics"
 	"github.com/JonasBak/autoscaler-proxy/utils"
-	"github.com/hetznercloud/hcloud-go/hcloud"
 )
 
 var log = utils.Logger().WithField("pkg", "autoscaler")
@@ -20,147 +22,293 @@ type UpstreamOpts struct {
 }
 
 type AutoscalerOpts struct {
+	// Which cloud to create servers in, defaults to hcloud
+	Provider    string `yaml:"provider"`
 	HCloudToken string `yaml:"hcloud_token"`
 
 	ConnectionTimeout time.Duration `yaml:"connection_timeout"`
 	ScaledownAfter    time.Duration `yaml:"scaledown_after"`
+	// How often to check if it is time to scale down, defaults to 2m
+	ScaledownInterval time.Duration `yaml:"scaledown_interval"`
 
 	ServerNamePrefix string `yaml:"server_name_prefix"`
 	ServerType       string `yaml:"server_type"`
 	ServerImage      string `yaml:"server_image"`
 	ServerLocation   string `yaml:"server_location"`
+	// Which address the autoscaler connects to the servers on, ipv4 (default), ipv6 or
+	// private. Servers are created without public ipv4 addresses for ipv6, and without any
+	// public addresses for private
+	AddressFamily string `yaml:"address_family"`
+	// Name or id of an existing hcloud network to attach the servers to, required for
+	// address_family private
+	Network string `yaml:"network"`
+
+	// Number of servers to always keep running, defaults to 0
+	MinServers int `yaml:"min_servers"`
+	// Max number of servers to run at the same time, defaults to 1
+	MaxServers int `yaml:"max_servers"`
+	// Number of connections per server before another server is created, defaults to 10
+	ScaleOutThreshold int `yaml:"scale_out_threshold"`
 
 	WaitFor *UpstreamOpts `yaml:"wait_for"`
+	SSH     SSHOpts       `yaml:"ssh"`
+
+	// Probes that have to pass before a new server is used
+	Readiness []ProbeOpts `yaml:"readiness"`
+	// Keep servers running while docker containers are running on them, disabled if unset
+	DockerKeepalive *DockerKeepaliveOpts `yaml:"docker_keepalive"`
 
 	CloudInitTemplate      map[string]interface{} `yaml:"cloud_init_template"`
 	CloudInitVariables     map[string]string      `yaml:"cloud_init_variables"`
 	CloudInitVariablesFrom string                 `yaml:"cloud_init_variables_from"`
-}
-
-func serverOptions(client *hcloud.Client, opts AutoscalerOpts, cloudInit string) hcloud.ServerCreateOpts {
-	serverType, _, err := client.ServerType.GetByName(context.Background(), opts.ServerType)
-	if err != nil {
-		log.WithError(err).WithField("server_type", opts.ServerType).Fatal("Failed to fetch hetzner server type")
-	}
-
-	image, _, err := client.Image.GetByName(context.Background(), opts.ServerImage)
-	if err != nil {
-		log.WithError(err).WithField("server_image", opts.ServerImage).Fatal("Failed to fetch hetzner server image")
-	}
-
-	var location *hcloud.Location = nil
-	if opts.ServerLocation != "" {
-		l, _, err := client.Location.GetByName(context.Background(), opts.ServerLocation)
-		if err != nil {
-			log.WithError(err).WithField("server_location", opts.ServerLocation).Fatal("Failed to fetch hetzner server location")
-		}
-		location = l
-	}
 
-	name := fmt.Sprintf("%s-%s", opts.ServerNamePrefix, utils.RandomString(6))
+	// Directory to persist ssh keys and servers in, so that servers can be reused after a restart
+	StateDir string `yaml:"state_dir"`
 
-	log = log.WithField("server", name)
-
-	return hcloud.ServerCreateOpts{
-		Name:       name,
-		ServerType: serverType,
-		Image:      image,
-		Location:   location,
-
-		UserData: cloudInit,
-	}
+	GC GCOpts `yaml:"gc"`
 }
 
 type Autoscaler struct {
-	client     *hcloud.Client
-	server     *hcloud.Server
-	serverOpts hcloud.ServerCreateOpts
+	provider Provider
+	// Servers that are created and ready to be used, guarded by mu as the connection
+	// counts are updated from the goroutines handling connections.
+	servers []*poolServer
+	mu      sync.Mutex
+	// Seconds the servers that have been deleted were running, guarded by mu
+	retiredUpSeconds float64
+	// Names of the servers being created in the background
+	creating map[string]bool
+	// Receives servers created in the background, handled by the goroutine running Start().
+	cCreated chan provisionResult
+	// User data passed to every server created
+	cloudInit string
+	// Builds the user data again, in CA mode every server gets a newly issued host
+	// certificate
+	renderCloudInit  func() (string, error)
+	serverNamePrefix string
+
+	minServers        int
+	maxServers        int
+	scaleOutThreshold int
 
 	// Used to connect to the server after it has been created. Generates a private key for
-	// itself and creates a private key for the server. Both of these are created on Start().
-	// Note that this means that one instance of the autoscaler can't talk to servers created
-	// by other instances.
+	// itself and creates a private key for the server. Both of these are created on New(),
+	// unless they have been persisted in stateDir. Note that this means that one instance of
+	// the autoscaler can't talk to servers created by other instances.
 	sshClient SSHClient
-	// Used to decide when it is time to scale down
-	lastInteraction time.Time
-	// The max length of time before a connection is forcefully closed. Used to avoid lingering
-	// connections keeping the server running.
+	sshOpts   SSHOpts
+	// Where keys and servers are persisted, empty if they shouldn't be
+	stateDir string
+	// Identifies the servers created by this instance, persisted in stateDir
+	instanceID string
+	gc         GCOpts
+	// How long a connection can go without any data flowing through it before it is closed.
+	// Used to avoid lingering connections keeping the server running.
 	connectionTimeout time.Duration
-	// How long to wait after lastInteraction before scaling down. Should be greater than
-	// connectionTimeout.
+	// How long a server has to be without connections, and without data flowing, before it
+	// is scaled down.
 	scaledownAfter time.Duration
+	// How often to evaluate scaledown
+	scaledownInterval time.Duration
 	// Channel used to communicate with the Start thread that it should be scaled up.
 	cUp chan chan error
+	// Channel used to communicate with the Start thread that idle servers should be deleted
+	cDown chan chan error
+	// Channel used to communicate with the Start thread that the servers should be drained
+	cDrain chan chan error
 	// Channel used to communicate with the Start thread that it should be shut down
 	cShutdown chan chan error
 
-	waitFor *UpstreamOpts
+	// Probes run when a server is created, starting with the ssh probe
+	readiness       []ProbeOpts
+	dockerKeepalive *DockerKeepaliveOpts
+}
+
+type provisionResult struct {
+	name   string
+	server *poolServer
+	err    error
+}
+
+func New(opts AutoscalerOpts) *Autoscaler {
+	return NewWithProvider(opts, newProvider(opts))
 }
 
-func New(opts AutoscalerOpts) Autoscaler {
-	client := hcloud.NewClient(hcloud.WithToken(opts.HCloudToken))
+func NewWithProvider(opts AutoscalerOpts, provider Provider) *Autoscaler {
+	sshClient := newSSHClient(opts.StateDir, opts.SSH)
 
-	sshClient := newSSHClient()
+	readiness, err := readinessProbes(opts.Readiness, opts.WaitFor)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid readiness probes")
+	}
+	if sshClient.ca != nil {
+		sshClient.ca.bootstrapCertValidity = readinessTimeout(readiness) + bootstrapCertMargin
+	}
 
-	cloudInit, err := CreateCloudInitFile(opts.CloudInitTemplate, opts, sshClient.remoteKey, sshClient.publicKey)
+	variables, err := loadCloudInitVariables(opts)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load cloud-init variables")
+	}
+	renderCloudInit := func() (string, error) {
+		return CreateCloudInitFile(opts.CloudInitTemplate, variables, opts.SSH.keyType(), sshClient)
+	}
+
+	cloudInit, err := renderCloudInit()
 	if err != nil {
 		log.WithError(err).Fatal("Failed to generate cloud-init.yml")
 	}
 
-	serverOpts := serverOptions(client, opts, cloudInit)
+	instanceID, err := loadOrGenerateInstanceID(opts.StateDir)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load instance id from state")
+	}
+
+	scaledownInterval := opts.ScaledownInterval
+	if scaledownInterval == 0 {
+		scaledownInterval = 2 * time.Minute
+	}
+	maxServers := opts.MaxServers
+	if maxServers == 0 {
+		maxServers = 1
+	}
+	if maxServers < opts.MinServers {
+		log.WithField("min_servers", opts.MinServers).WithField("max_servers", maxServers).Fatal("min_servers can't be greater than max_servers")
+	}
+	scaleOutThreshold := opts.ScaleOutThreshold
+	if scaleOutThreshold == 0 {
+		scaleOutThreshold = 10
+	}
 
-	as := Autoscaler{
-		client:            client,
-		serverOpts:        serverOpts,
+	as := &Autoscaler{
+		provider:          provider,
+		creating:          make(map[string]bool),
+		cCreated:          make(chan provisionResult),
+		cloudInit:         cloudInit,
+		renderCloudInit:   renderCloudInit,
+		serverNamePrefix:  opts.ServerNamePrefix,
+		minServers:        opts.MinServers,
+		maxServers:        maxServers,
+		scaleOutThreshold: scaleOutThreshold,
 		sshClient:         sshClient,
-		lastInteraction:   time.Now(),
+		sshOpts:           opts.SSH,
+		stateDir:          opts.StateDir,
+		instanceID:        instanceID,
+		gc:                opts.GC,
 		connectionTimeout: opts.ConnectionTimeout,
 		scaledownAfter:    opts.ScaledownAfter,
+		scaledownInterval: scaledownInterval,
 		cUp:               make(chan chan error),
+		cDown:             make(chan chan error),
+		cDrain:            make(chan chan error),
 		cShutdown:         make(chan chan error),
-		waitFor:           opts.WaitFor,
+		readiness:         readiness,
+		dockerKeepalive:   opts.DockerKeepalive,
 	}
 
 	return as
 }
 
-func (as *Autoscaler) createServer() error {
-	if as.server != nil {
-		return fmt.Errorf("Server already exists")
+func (as *Autoscaler) serverCreateOpts() ServerCreateOpts {
+	return ServerCreateOpts{
+		Name:     fmt.Sprintf("%s-%s", as.serverNamePrefix, utils.RandomString(6)),
+		UserData: as.cloudInit,
+		Labels:   map[string]string{instanceLabel: as.instanceID},
 	}
+}
+
+// Creates a server and waits for it to pass the readiness probes. If the server never
+// becomes ready it is deleted.
+func (as *Autoscaler) provisionServer(opts ServerCreateOpts) (*poolServer, error) {
+	log := log.WithField("server", opts.Name)
 
 	log.Info("Creating server")
 
-	result, _, err := as.client.Server.Create(context.Background(), as.serverOpts)
+	start := time.Now()
+	stage := time.Now()
+	observeStage := func(name string) {
+		metrics.ScaleUpDuration.WithLabelValues(name).Observe(time.Since(stage).Seconds())
+		stage = time.Now()
+	}
+
+	if as.sshClient.ca != nil {
+		// The host certificate in the cloud-init file is valid from when the server is created
+		userData, err := as.renderCloudInit()
+		if err != nil {
+			return nil, err
+		}
+		opts.UserData = userData
+	}
+
+	server, err := as.provider.CreateServer(context.Background(), opts)
 	if err != nil {
 		log.WithError(err).Error("Failed to create server")
-		return err
+		return nil, err
 	}
 
-	log.Info("Waiting for server to start")
-	_, c := as.client.Action.WatchProgress(context.Background(), result.Action)
+	log.Info("Server created")
+	observeStage("create")
 
-	err = <-c
+	addr, err := as.provider.Address(server)
+	if err == nil {
+		log.Info("Waiting for server to be ready")
+		err = as.waitUntilReady(addr, observeStage)
+	}
 	if err != nil {
-		log.WithError(err).Error("Failed to start server")
-		return err
+		log.WithError(err).Error("Server didn't become ready, deleting it")
+		if err := as.provider.DeleteServer(context.Background(), server); err != nil {
+			log.WithError(err).Error("Failed to delete server")
+		}
+		return nil, err
 	}
 
-	log.Info("Server created")
+	metrics.ScaleUpDuration.WithLabelValues("total").Observe(time.Since(start).Seconds())
 
-	as.server = result.Server
+	s := newPoolServer(server, addr, as.newSSHConnPool(addr))
+	s.healthy = true
+	s.lastSeen = time.Now()
 
-	return nil
+	return s, nil
+}
+
+func (as *Autoscaler) addServer(s *poolServer) {
+	as.mu.Lock()
+	as.servers = append(as.servers, s)
+	as.saveState()
+	as.mu.Unlock()
+
+	// Replace the host certificate from the cloud-init file with one bound to the address
+	as.renewHostCerts()
+}
+
+// Starts creating a server in the background, the result is handled by the goroutine
+// running Start().
+func (as *Autoscaler) scaleOut() {
+	opts := as.serverCreateOpts()
+	as.creating[opts.Name] = true
+
+	go func() {
+		s, err := as.provisionServer(opts)
+		as.cCreated <- provisionResult{name: opts.Name, server: s, err: err}
+	}()
 }
 
-func (as *Autoscaler) deleteServer() error {
-	if as.server == nil {
-		return nil
+func (as *Autoscaler) handleProvisionResult(r provisionResult) {
+	delete(as.creating, r.name)
+
+	if r.err != nil {
+		log.WithError(r.err).Error("Failed to scale out")
+	}
+	if r.server != nil {
+		as.addServer(r.server)
 	}
+}
+
+func (as *Autoscaler) deleteServer(s *poolServer) error {
+	log := log.WithField("server", s.server.Name)
 
 	log.Info("Deleting server")
 
-	_, err := as.client.Server.Delete(context.Background(), as.server)
+	err := as.provider.DeleteServer(context.Background(), s.server)
 	if err != nil {
 		log.WithError(err).Error("Failed to delete server")
 		return err
@@ -168,73 +316,256 @@ func (as *Autoscaler) deleteServer() error {
 
 	log.Info("Server deleted")
 
-	as.server = nil
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	for i, s2 := range as.servers {
+		if s2 == s {
+			as.servers = append(as.servers[:i], as.servers[i+1:]...)
+			as.retiredUpSeconds += time.Since(s.server.Created).Seconds()
+			s.ssh.Close()
+			break
+		}
+	}
+	as.saveState()
 
 	return nil
 }
 
-// This function will check if it is time to scale down. This decision is based
-// on the time since last (EnsureOnline) interaction with the autoscaler.
+// Deletes all servers, including the ones being created.
+func (as *Autoscaler) deleteServers() error {
+	for len(as.creating) > 0 {
+		as.handleProvisionResult(<-as.cCreated)
+	}
+
+	as.mu.Lock()
+	servers := append([]*poolServer{}, as.servers...)
+	as.mu.Unlock()
+
+	return as.removeServers(servers)
+}
+
+// Makes sure there are at least minServers healthy servers, creating the missing ones in
+// the background.
+func (as *Autoscaler) ensureMinServers() {
+	as.mu.Lock()
+	missing := as.minServers - len(healthyServers(as.servers)) - len(as.creating)
+	as.mu.Unlock()
+
+	for i := 0; i < missing; i++ {
+		as.scaleOut()
+	}
+}
+
+// This function will check if it is time to scale down. A server is scaled down when it has
+// been without connections for scaledownAfter, one server at a time, down to minServers.
+// If dockerKeepalive is set, servers running containers are kept. Draining servers are
+// deleted as soon as they have no connections.
 // This version of the function should only be called from the goroutine running Start().
 func (as *Autoscaler) evaluateScaledown(ctx context.Context) error {
-	if as.server == nil {
-		return nil
+	as.mu.Lock()
+	log.WithField("servers", len(as.servers)).Debug("Evaluating scaledown")
+	remove := drainedServers(as.servers)
+	healthy := healthyServers(as.servers)
+	idle := []*poolServer{}
+	if len(healthy) > as.minServers {
+		idle = idleServers(healthy, as.scaledownAfter)
 	}
+	as.mu.Unlock()
 
-	timeSinceLastInteraction := time.Now().Sub(as.lastInteraction)
+	for _, s := range idle {
+		if as.keptAliveByDocker(ctx, s) {
+			s.touch()
+			continue
+		}
+		remove = append(remove, s)
+		break
+	}
 
-	log.WithField("time_since_last_interaction", timeSinceLastInteraction.String()).Debug("Evaluating scaledown")
+	return as.removeServers(remove)
+}
 
-	if timeSinceLastInteraction <= as.scaledownAfter {
-		return nil
+// Deletes every server without connections, ignoring scaledownAfter, down to minServers.
+// This version of the function should only be called from the goroutine running Start().
+func (as *Autoscaler) scaleDown(ctx context.Context) error {
+	as.mu.Lock()
+	remove := drainedServers(as.servers)
+	healthy := healthyServers(as.servers)
+	idle := idleServers(healthy, 0)
+	// There can be fewer healthy servers than minServers, while they are being created or
+	// replaced
+	n := len(healthy) - as.minServers
+	if n < 0 {
+		n = 0
+	}
+	if len(idle) > n {
+		idle = idle[:n]
 	}
+	remove = append(remove, idle...)
+	as.mu.Unlock()
 
-	return as.deleteServer()
+	return as.removeServers(remove)
 }
 
-// This function should be called before GetConnection to ensure that the
-// server is online before trying to connect to it. This version
-// of the function should only be called from the goroutine running Start(),
-// other should use EnsureOnline.
+// Marks all servers as draining, so that new connections go to new servers, and deletes
+// the servers as their connections close.
+// This version of the function should only be called from the goroutine running Start().
+func (as *Autoscaler) drain(ctx context.Context) error {
+	as.mu.Lock()
+	for _, s := range as.servers {
+		s.draining = true
+	}
+	remove := drainedServers(as.servers)
+	as.mu.Unlock()
+
+	return as.removeServers(remove)
+}
+
+func (as *Autoscaler) removeServers(servers []*poolServer) error {
+	errs := []error{}
+	for _, s := range servers {
+		if err := as.deleteServer(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// This function should be called before GetConnection to ensure that there is a
+// server online before trying to connect to it. If all servers are busy, another
+// server is created in the background. This version of the function should only
+// be called from the goroutine running Start(), other should use EnsureOnline.
 func (as *Autoscaler) ensureOnline(ctx context.Context) error {
 	log.Debug("Making sure server is online")
 
-	as.lastInteraction = time.Now()
+	var online *poolServer
+	for {
+		online = as.pingServers()
+		if online != nil {
+			break
+		}
 
-	if as.server == nil {
-		log.Info("No server online, will be created")
-		err := as.createServer()
-		if err != nil {
-			return err
+		as.removeFailedServers()
+
+		if len(as.creating) > 0 {
+			log.Info("No server online, waiting for server being created")
+			as.handleProvisionResult(<-as.cCreated)
+			continue
 		}
 
-		log.Info("Waiting for ping")
-		err = ping(6, 4, 5, as.server.PublicNet.IPv4.IP.String()+":22")
-		if err != nil {
-			return err
+		as.mu.Lock()
+		total := len(healthyServers(as.servers))
+		as.mu.Unlock()
+
+		if total >= as.maxServers {
+			return fmt.Errorf("No servers online, and max number of servers reached")
 		}
-		if waitFor := as.waitFor; waitFor != nil {
-			log.Info("Pinging wait_for")
-			sshConn, err := as.sshClient.Connect(as.server.PublicNet.IPv4.IP.String() + ":22")
-			if err != nil {
-				return err
-			}
-			defer sshConn.Close()
-			pingConn(6, 5, func() (net.Conn, error) {
-				return sshConn.Dial(waitFor.Net, waitFor.Addr)
-			})
+
+		log.Info("No server online, will be created")
+		s, err := as.provisionServer(as.serverCreateOpts())
+		if s != nil {
+			as.addServer(s)
 		}
-	} else {
-		err := ping(2, 2, 1, as.server.PublicNet.IPv4.IP.String()+":22")
-		if err != nil {
-			return err
+		return err
+	}
+
+	as.mu.Lock()
+	total := len(healthyServers(as.servers)) + len(as.creating)
+	busy := online.connections >= as.scaleOutThreshold
+	as.mu.Unlock()
+
+	if busy && total < as.maxServers {
+		log.Info("All servers are busy, scaling out")
+		as.scaleOut()
+	}
+
+	return nil
+}
+
+// Servers that don't respond to this many pings in a row are deleted, and replaced if needed
+const maxFailedPings = 3
+
+// Servers seen alive this recently aren't pinged again
+const seenRecently = 10 * time.Second
+
+// Pings the servers, fewest connections first, until one responds. Updates the health of
+// the servers pinged, and returns the one responding. Healthy servers seen alive recently
+// are returned without pinging them again.
+func (as *Autoscaler) pingServers() *poolServer {
+	as.mu.Lock()
+	candidates := sortedByConnections(activeServers(as.servers))
+	as.mu.Unlock()
+
+	for _, s := range candidates {
+		as.mu.Lock()
+		recent := s.healthy && time.Since(s.lastSeen) < seenRecently
+		as.mu.Unlock()
+		if recent {
+			return s
 		}
 
+		if as.pingServer(s) == nil {
+			return s
+		}
 	}
 
 	return nil
 }
 
+// Pings s and updates its health
+func (as *Autoscaler) pingServer(s *poolServer) error {
+	err := ping(as.sshClient.dial, 2, 2, 1, s.addr)
+
+	as.mu.Lock()
+	s.healthy = err == nil
+	if err == nil {
+		s.lastSeen = time.Now()
+		s.failedPings = 0
+	} else {
+		s.failedPings++
+	}
+	as.mu.Unlock()
+
+	if err != nil {
+		log.WithError(err).WithField("server", s.server.Name).Warn("Server didn't respond to ping")
+	}
+	return err
+}
+
+// Pings the servers that haven't been seen recently, and deletes the ones that haven't
+// responded to maxFailedPings pings in a row, so they can be replaced.
+// This version of the function should only be called from the goroutine running Start().
+func (as *Autoscaler) checkServers() {
+	as.mu.Lock()
+	candidates := activeServers(as.servers)
+	as.mu.Unlock()
+
+	for _, s := range candidates {
+		as.mu.Lock()
+		recent := s.healthy && time.Since(s.lastSeen) < seenRecently
+		as.mu.Unlock()
+		if !recent {
+			as.pingServer(s)
+		}
+	}
+
+	as.removeFailedServers()
+}
+
+// Deletes the servers that haven't responded to maxFailedPings pings in a row
+func (as *Autoscaler) removeFailedServers() {
+	as.mu.Lock()
+	failed := failedServers(as.servers)
+	as.mu.Unlock()
+
+	for _, s := range failed {
+		log.WithField("server", s.server.Name).Warn("Server stopped responding, deleting it")
+	}
+	if err := as.removeServers(failed); err != nil {
+		log.WithError(err).Error("Failed to delete servers that stopped responding")
+	}
+}
+
 // Threadsafe version of ensureOnline, idempotent.
 func (as *Autoscaler) EnsureOnline(ctx context.Context) error {
 	c := make(chan error)
@@ -242,36 +573,163 @@ func (as *Autoscaler) EnsureOnline(ctx context.Context) error {
 	return <-c
 }
 
+// Threadsafe version of scaleDown.
+func (as *Autoscaler) ScaleDown(ctx context.Context) error {
+	c := make(chan error)
+	as.cDown <- c
+	return <-c
+}
+
+// Threadsafe version of drain.
+func (as *Autoscaler) Drain(ctx context.Context) error {
+	c := make(chan error)
+	as.cDrain <- c
+	return <-c
+}
+
+type ServerStatus struct {
+	Name            string    `json:"name"`
+	IP              string    `json:"ip"`
+	Healthy         bool      `json:"healthy"`
+	Draining        bool      `json:"draining"`
+	Connections     int       `json:"connections"`
+	Created         time.Time `json:"created"`
+	Uptime          string    `json:"uptime"`
+	LastInteraction time.Time `json:"last_interaction"`
+}
+
+// Returns the status of the servers in the pool.
+func (as *Autoscaler) Status() []ServerStatus {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	status := []ServerStatus{}
+	for _, s := range as.servers {
+		ip, _, _ := net.SplitHostPort(s.addr)
+		status = append(status, ServerStatus{
+			Name:            s.server.Name,
+			IP:              ip,
+			Healthy:         s.healthy,
+			Draining:        s.draining,
+			Connections:     s.connections,
+			Created:         s.server.Created,
+			Uptime:          time.Since(s.server.Created).Round(time.Second).String(),
+			LastInteraction: s.lastActive(),
+		})
+	}
+
+	return status
+}
+
+// Whether there is a healthy server to connect to. Doesn't ping or create any servers, see
+// EnsureOnline for that.
+func (as *Autoscaler) Online() bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	return leastConnections(as.servers) != nil
+}
+
+// Returns the total number of seconds servers have been running, including the deleted ones.
+func (as *Autoscaler) UpSeconds() float64 {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	upSeconds := as.retiredUpSeconds
+	for _, s := range as.servers {
+		upSeconds += time.Since(s.server.Created).Seconds()
+	}
+
+	return upSeconds
+}
+
+// Opens a connection to opts on the healthy server with the fewest connections. The
+// connection is closed if no data has flowed through it for connectionTimeout.
 func (as *Autoscaler) GetConnection(ctx context.Context, opts UpstreamOpts) (io.ReadWriteCloser, error) {
-	// TODO Could share one ssh connection?
-	sshConn, err := as.sshClient.Connect(as.server.PublicNet.IPv4.IP.String() + ":22")
+	as.mu.Lock()
+	s := leastConnections(as.servers)
+	if s != nil {
+		s.connections++
+		s.touch()
+	}
+	as.mu.Unlock()
+
+	if s == nil {
+		return nil, fmt.Errorf("No server online")
+	}
+
+	release := func() {
+		as.mu.Lock()
+		s.connections--
+		s.touch()
+		as.mu.Unlock()
+	}
+
+	var conn io.ReadWriteCloser
+	var err error
+	if opts.Net == "udp" {
+		conn, err = s.ssh.DialUDP(ctx, opts.Addr)
+	} else {
+		conn, err = s.ssh.Dial(ctx, opts.Net, opts.Addr)
+	}
 	if err != nil {
+		release()
 		return nil, err
 	}
-	conn, err := sshConn.Dial(opts.Net, opts.Addr)
-	rwc, c := utils.NewReadWriteCloseNotifier(conn)
+	as.mu.Lock()
+	s.lastSeen = time.Now()
+	as.mu.Unlock()
 
-	if err == nil {
-		go func() {
-			defer sshConn.Close()
+	tracked := newTrackedConn(conn, s)
+	rwc, c := utils.NewReadWriteCloseNotifier(tracked)
+
+	go func() {
+		defer release()
+
+		timer := time.NewTimer(as.connectionTimeout)
+		defer timer.Stop()
+		for {
 			select {
-			case <-time.NewTimer(as.connectionTimeout).C:
-				log.Warn("Connection has been open for too long, closing")
+			case <-timer.C:
+				idle := tracked.idle()
+				if idle < as.connectionTimeout {
+					timer.Reset(as.connectionTimeout - idle)
+					continue
+				}
+				log.Warn("Connection has been idle for too long, closing")
 				rwc.Close()
+				return
 			case <-c:
-				break
+				return
 			}
-		}()
-	}
+		}
+	}()
 
-	return rwc, err
+	return rwc, nil
 }
 
 // Starts the autoscaler. This is blocking and should be started in its own goroutine.
 func (as *Autoscaler) Start(ctx context.Context) {
 	log.Info("Starting autoscaler")
 
-	ticker := time.NewTicker(2 * time.Minute)
+	if err := as.adoptServers(ctx); err != nil {
+		log.WithError(err).Error("Failed to adopt servers from state")
+	}
+
+	var gc <-chan time.Time
+	if as.gc.Interval > 0 {
+		if err := as.collectGarbage(ctx); err != nil {
+			log.WithError(err).Error("Failed to collect garbage")
+		}
+
+		gcTicker := time.NewTicker(as.gc.Interval)
+		defer gcTicker.Stop()
+		gc = gcTicker.C
+	}
+
+	as.ensureMinServers()
+
+	ticker := time.NewTicker(as.scaledownInterval)
 	defer ticker.Stop()
 LOOP:
 	for {
@@ -280,17 +738,46 @@ LOOP:
 			err := as.ensureOnline(ctx)
 			if err != nil {
 				log.WithError(err).Error("Failed ensure online")
+				metrics.EnsureOnlineFailures.Inc()
 			}
 			c <- err
 			break
+		case r := <-as.cCreated:
+			as.handleProvisionResult(r)
+			break
 		case <-ticker.C:
+			as.checkServers()
 			err := as.evaluateScaledown(ctx)
 			if err != nil {
 				log.WithError(err).Error("Failed evaluate scaledown")
 			}
+			as.ensureMinServers()
+			as.renewHostCerts()
+			break
+		case <-gc:
+			err := as.collectGarbage(ctx)
+			if err != nil {
+				log.WithError(err).Error("Failed to collect garbage")
+			}
+			as.ensureMinServers()
+			break
+		case c := <-as.cDown:
+			err := as.scaleDown(ctx)
+			if err != nil {
+				log.WithError(err).Error("Failed scale down")
+			}
+			c <- err
+			break
+		case c := <-as.cDrain:
+			err := as.drain(ctx)
+			if err != nil {
+				log.WithError(err).Error("Failed drain")
+			}
+			as.ensureMinServers()
+			c <- err
 			break
 		case c := <-as.cShutdown:
-			c <- as.deleteServer()
+			c <- as.deleteServers()
 			break LOOP
 		}
 	}
@@ -0,0 +1,1060 @@
+package autoscaler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JonasBak/autoscaler-proxy/internal/fakeprovider"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	// Speeds up key generation, the key size is irrelevant for the tests
+	RSA_KEY_BITS = 2048
+}
+
+func testOpts() AutoscalerOpts {
+	return AutoscalerOpts{
+		ConnectionTimeout: time.Minute,
+		ScaledownAfter:    time.Minute,
+		ServerNamePrefix:  "test",
+		CloudInitTemplate: map[string]interface{}{
+			"ssh_keys": map[string]string{
+				"rsa_private": "${SERVER_RSA_PRIVATE}",
+				"rsa_public":  "${SERVER_RSA_PUBLIC}",
+			},
+			"users": []interface{}{
+				"default",
+				map[string]interface{}{
+					"name":                "autoscaler",
+					"ssh_authorized_keys": []string{"${AUTOSCALER_AUTHORIZED_KEY}"},
+				},
+			},
+		},
+	}
+}
+
+func startEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func assertEcho(t *testing.T, rw io.ReadWriter, msg string) {
+	if _, err := rw.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("Expected '%s', got '%s'", msg, buf)
+	}
+}
+
+func TestEnsureOnlineCreatesServer(t *testing.T) {
+	provider := fakeprovider.New()
+	as := NewWithProvider(testOpts(), provider)
+	ctx := context.Background()
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := provider.Running(); n != 1 {
+		t.Fatalf("Expected 1 server running, got %d", n)
+	}
+
+	conn, err := as.GetConnection(ctx, UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, "hello")
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := provider.Running(); n != 1 {
+		t.Fatalf("Expected server to be reused, got %d servers", n)
+	}
+}
+
+func TestEvaluateScaledown(t *testing.T) {
+	opts := testOpts()
+	opts.ScaledownAfter = 50 * time.Millisecond
+	provider := fakeprovider.New()
+	as := NewWithProvider(opts, provider)
+	ctx := context.Background()
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := as.evaluateScaledown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := provider.Running(); n != 1 {
+		t.Fatalf("Expected server to still be running, got %d servers", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := as.evaluateScaledown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := provider.Running(); n != 0 {
+		t.Fatalf("Expected server to be scaled down, got %d servers", n)
+	}
+}
+
+func TestFakeServerOnlyAcceptsGeneratedKeys(t *testing.T) {
+	provider := fakeprovider.New()
+	as := NewWithProvider(testOpts(), provider)
+
+	server, err := provider.CreateServer(context.Background(), as.serverCreateOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := provider.Address(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := as.sshClient.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	other := newSSHClient("", SSHOpts{})
+
+	wrongClientKey := other.config
+	wrongClientKey.HostKeyCallback = as.sshClient.config.HostKeyCallback
+	if _, err := ssh.Dial("tcp", addr, &wrongClientKey); err == nil {
+		t.Error("Expected connection with unknown client key to fail")
+	}
+
+	wrongHostKey := as.sshClient.config
+	wrongHostKey.HostKeyCallback = other.config.HostKeyCallback
+	if _, err := ssh.Dial("tcp", addr, &wrongHostKey); err == nil {
+		t.Error("Expected connection to server with unexpected host key to fail")
+	}
+}
+
+func TestKeyTypes(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ecdsa", "ed25519"} {
+		t.Run(keyType, func(t *testing.T) {
+			upper := strings.ToUpper(keyType)
+			opts := testOpts()
+			opts.SSH.KeyType = keyType
+			opts.CloudInitTemplate["ssh_keys"] = map[string]string{
+				keyType + "_private": fmt.Sprintf("${SERVER_%s_PRIVATE}", upper),
+				keyType + "_public":  fmt.Sprintf("${SERVER_%s_PUBLIC}", upper),
+			}
+			as := NewWithProvider(opts, fakeprovider.New())
+			ctx := context.Background()
+			defer as.deleteServers()
+
+			if err := as.ensureOnline(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := as.GetConnection(ctx, UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn, "hello")
+		})
+	}
+}
+
+func TestBringYourOwnKeys(t *testing.T) {
+	clientKey, err := generatePrivateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := generatePrivateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.ParsePrivateKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stands in for servers from an image that already has a known host key
+	byoOpts := func() AutoscalerOpts {
+		opts := testOpts()
+		opts.SSH.HostKey = string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey()))
+		opts.CloudInitVariables = map[string]string{"HOST_KEY": string(hostKey)}
+		opts.CloudInitTemplate["ssh_keys"] = map[string]string{"ed25519_private": "${HOST_KEY}"}
+		return opts
+	}
+
+	clientKeyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(clientKeyFile, clientKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := ssh.ParseRawPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: rawKey}); err != nil {
+		t.Fatal(err)
+	}
+	agentSock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", agentSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", agentSock)
+
+	for name, setKey := range map[string]func(*AutoscalerOpts){
+		"file":  func(opts *AutoscalerOpts) { opts.SSH.ClientKeyFile = clientKeyFile },
+		"agent": func(opts *AutoscalerOpts) { opts.SSH.Agent = true },
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts := byoOpts()
+			setKey(&opts)
+			as := NewWithProvider(opts, fakeprovider.New())
+			ctx := context.Background()
+			defer as.deleteServers()
+
+			if as.sshClient.remoteKey != nil {
+				t.Error("Expected no host key to be generated when it is pinned")
+			}
+			if string(as.sshClient.publicKey.Marshal()) != string(signer.PublicKey().Marshal()) {
+				t.Error("Expected the configured client key to be used")
+			}
+
+			if err := as.ensureOnline(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := as.GetConnection(ctx, UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn, "hello")
+		})
+	}
+}
+
+// Options for a CA mode autoscaler, renewed host certificates are written to certFile
+func testCAOpts(certFile string) AutoscalerOpts {
+	opts := testOpts()
+	opts.SSH.KeyType = "ed25519"
+	opts.SSH.CA = CAOpts{
+		Enabled:          true,
+		UserCertValidity: 2 * time.Second,
+		HostCertValidity: time.Hour,
+		RenewCommand:     "cat > " + certFile,
+	}
+	opts.CloudInitTemplate = map[string]interface{}{
+		"ssh_keys": map[string]string{
+			"ed25519_private":     "${SERVER_ED25519_PRIVATE}",
+			"ed25519_certificate": "${SERVER_ED25519_CERTIFICATE}",
+		},
+		"write_files": []interface{}{
+			map[string]interface{}{
+				"path":    "/etc/ssh/sshd_config.d/ca.conf",
+				"content": "TrustedUserCAKeys /etc/ssh/ca.pub\n",
+			},
+			map[string]interface{}{
+				"path":    "/etc/ssh/ca.pub",
+				"content": "${SSH_CA_PUBLIC}",
+			},
+		},
+	}
+	return opts
+}
+
+func TestCertificateAuthority(t *testing.T) {
+	certFile := filepath.Join(t.TempDir(), "cert")
+	opts := testCAOpts(certFile)
+	provider := fakeprovider.New()
+	as := NewWithProvider(opts, provider)
+	ctx := context.Background()
+	defer as.deleteServers()
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := as.GetConnection(ctx, UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, "hello")
+
+	addr, err := provider.Address(as.servers[0].server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate in the cloud-init file is only valid until the server has had time to
+	// become ready
+	cloudInit := struct {
+		SSHKeys map[string]string `yaml:"ssh_keys"`
+	}{}
+	if err := yaml.Unmarshal([]byte(as.cloudInit), &cloudInit); err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cloudInit.SSHKeys["ed25519_certificate"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bootstrap := key.(*ssh.Certificate)
+	maxValidBefore := time.Now().Add(readinessTimeout(as.readiness) + bootstrapCertMargin)
+	if len(bootstrap.ValidPrincipals) != 0 || bootstrap.ValidBefore > uint64(maxValidBefore.Unix()) {
+		t.Errorf("Unexpected bootstrap host certificate %v %v", bootstrap.ValidPrincipals, bootstrap.ValidBefore)
+	}
+
+	// The server gets a host certificate bound to its address
+	var cert *ssh.Certificate
+	for deadline := time.Now().Add(5 * time.Second); cert == nil; time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Host certificate wasn't renewed")
+		}
+		content, _ := os.ReadFile(certFile)
+		if key, _, _, _, err := ssh.ParseAuthorizedKey(content); err == nil {
+			cert = key.(*ssh.Certificate)
+		}
+	}
+	if cert.CertType != ssh.HostCert || len(cert.ValidPrincipals) != 1 || cert.ValidPrincipals[0] != "127.0.0.1" {
+		t.Errorf("Unexpected host certificate %v %v", cert.CertType, cert.ValidPrincipals)
+	}
+	if cert.ValidBefore > uint64(time.Now().Add(time.Hour).Unix()) {
+		t.Errorf("Expected host certificate to be valid for at most an hour")
+	}
+	if err := as.sshClient.config.HostKeyCallback(addr, nil, cert); err != nil {
+		t.Errorf("Expected renewed host certificate to be trusted: %v", err)
+	}
+
+	// A certificate for another address isn't trusted
+	other, err := as.sshClient.ca.signHostKey([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := as.sshClient.config.HostKeyCallback(addr, nil, other); err == nil {
+		t.Error("Expected host certificate for another address to be rejected")
+	}
+
+	// The first certificate has expired, a new one should be issued
+	time.Sleep(3 * time.Second)
+	client, err := as.sshClient.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	// A host presenting a plain key isn't trusted, even if it is the right key
+	plain := testOpts()
+	plain.SSH.KeyType = "ed25519"
+	plain.CloudInitTemplate["ssh_keys"] = map[string]string{"ed25519_private": string(as.sshClient.remoteKey)}
+	plainAs := NewWithProvider(plain, provider)
+	server, err := provider.CreateServer(ctx, plainAs.serverCreateOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.DeleteServer(ctx, server)
+	addr, err = provider.Address(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := plainAs.sshClient.config
+	config.HostKeyCallback = as.sshClient.config.HostKeyCallback
+	if _, err := ssh.Dial("tcp", addr, &config); err == nil {
+		t.Error("Expected connection to host without certificate to fail")
+	}
+}
+
+// Servers created at the same time each get their own cloud-init file
+func TestCertificateAuthorityConcurrentServers(t *testing.T) {
+	opts := testCAOpts("/dev/null")
+	opts.MinServers = 3
+	opts.MaxServers = 3
+	// Like the default config
+	opts.CloudInitVariables = map[string]string{}
+	as := NewWithProvider(opts, fakeprovider.New())
+	defer as.deleteServers()
+
+	as.ensureMinServers()
+	for len(as.creating) > 0 {
+		as.handleProvisionResult(<-as.cCreated)
+	}
+
+	if len(as.servers) != 3 {
+		t.Fatalf("Expected 3 servers, got %d", len(as.servers))
+	}
+	for _, s := range as.servers {
+		if _, err := s.ssh.Dial(context.Background(), "tcp", startEchoServer(t)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestJumpHost(t *testing.T) {
+	clientKey, err := generatePrivateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSigner, err := ssh.ParsePrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKeyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(clientKeyFile, clientKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	bastionKey, err := generatePrivateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bastionSigner, err := ssh.ParsePrivateKey(bastionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake servers forward connections, so one of them can act as the bastion
+	bastions := fakeprovider.New()
+	ctx := context.Background()
+	userData, err := yaml.Marshal(map[string]interface{}{
+		"ssh_keys": map[string]string{"ed25519_private": string(bastionKey)},
+		"users": []interface{}{
+			map[string]interface{}{
+				"name":                "bastion",
+				"ssh_authorized_keys": []string{string(ssh.MarshalAuthorizedKey(clientSigner.PublicKey()))},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bastion, err := bastions.CreateServer(ctx, ServerCreateOpts{Name: "bastion", UserData: string(userData)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bastions.DeleteServer(ctx, bastion)
+	bastionAddr, err := bastions.Address(bastion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOpts()
+	opts.SSH.User = "builder"
+	opts.SSH.ClientKeyFile = clientKeyFile
+	opts.SSH.JumpHost = JumpHostOpts{
+		Addr:    bastionAddr,
+		User:    "bastion",
+		HostKey: string(ssh.MarshalAuthorizedKey(bastionSigner.PublicKey())),
+	}
+	opts.CloudInitTemplate["users"] = []interface{}{
+		map[string]interface{}{
+			"name":                "builder",
+			"ssh_authorized_keys": []string{"${AUTOSCALER_AUTHORIZED_KEY}"},
+		},
+	}
+	as := NewWithProvider(opts, fakeprovider.New())
+	defer as.deleteServers()
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := as.GetConnection(ctx, UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, "hello")
+
+	accepted, err := bastions.Accepted(bastion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted == 0 {
+		t.Error("Expected the connections to go through the bastion")
+	}
+}
+
+// A jump host that accepts connections but never answers doesn't hold up dials with a
+// timeout, while another dial waits for it without one
+func TestJumpHostUnresponsive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	mu := sync.Mutex{}
+	accepted := []net.Conn{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepted = append(accepted, conn)
+			mu.Unlock()
+		}
+	}()
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range accepted {
+			conn.Close()
+		}
+	}()
+
+	key, err := generatePrivateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jump, err := newJumpHost(JumpHostOpts{
+		Addr:    l.Addr().String(),
+		HostKey: string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+	}, "autoscaler", []ssh.Signer{signer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go jump.dial("127.0.0.1:1", 0)
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := jump.dial("127.0.0.1:1", 200*time.Millisecond); err == nil {
+		t.Fatal("Expected dial through unresponsive jump host to fail")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Dial took %s, expected it to give up after its timeout", time.Since(start))
+	}
+}
+func TestScaleOutToLeastConnections(t *testing.T) {
+	opts := testOpts()
+	opts.MaxServers = 2
+	opts.ScaleOutThreshold = 1
+	provider := fakeprovider.New()
+	as := NewWithProvider(opts, provider)
+	ctx := context.Background()
+	echo := UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)}
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c1, err := as.GetConnection(ctx, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	// The only server is at the threshold, so another one is created in the background
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(as.creating) != 1 {
+		t.Fatalf("Expected a server to be created in the background")
+	}
+	as.handleProvisionResult(<-as.cCreated)
+	if n := provider.Running(); n != 2 {
+		t.Fatalf("Expected 2 servers running, got %d", n)
+	}
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := as.GetConnection(ctx, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	assertEcho(t, c2, "hello")
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	for _, s := range as.servers {
+		if s.connections != 1 {
+			t.Errorf("Expected connections to be spread across servers, %s has %d", s.server.Name, s.connections)
+		}
+	}
+}
+
+func TestScaledownToMinServers(t *testing.T) {
+	opts := testOpts()
+	opts.MinServers = 1
+	opts.MaxServers = 3
+	opts.ScaledownAfter = 10 * time.Millisecond
+	provider := fakeprovider.New()
+	as := NewWithProvider(opts, provider)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		s, err := as.provisionServer(as.serverCreateOpts())
+		if err != nil {
+			t.Fatal(err)
+		}
+		as.addServer(s)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	for _, expected := range []int{2, 1, 1} {
+		if err := as.evaluateScaledown(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if n := provider.Running(); n != expected {
+			t.Fatalf("Expected %d servers running, got %d", expected, n)
+		}
+	}
+}
+
+// A server that stops responding is replaced, even with max_servers reached, and deleted
+func TestUnhealthyServerReplaced(t *testing.T) {
+	opts := testOpts()
+	opts.MinServers = 1
+	opts.MaxServers = 1
+	provider := fakeprovider.New()
+	as := NewWithProvider(opts, provider)
+	ctx := context.Background()
+	defer as.deleteServers()
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+	crashed := as.servers[0]
+	if err := provider.Crash(crashed.server); err != nil {
+		t.Fatal(err)
+	}
+	as.mu.Lock()
+	crashed.lastSeen = time.Time{}
+	as.mu.Unlock()
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := as.GetConnection(ctx, UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, "hello")
+
+	for i := 1; i < maxFailedPings; i++ {
+		as.checkServers()
+	}
+	if len(as.servers) != 1 || as.servers[0] == crashed {
+		t.Errorf("Expected the crashed server to be replaced")
+	}
+	if provider.Running() != 1 {
+		t.Errorf("Expected the crashed server to be deleted, %d running", provider.Running())
+	}
+}
+
+func TestScaleDownBelowMinServers(t *testing.T) {
+	opts := testOpts()
+	opts.MinServers = 2
+	opts.MaxServers = 3
+	provider := fakeprovider.New()
+	as := NewWithProvider(opts, provider)
+	ctx := context.Background()
+
+	// No servers at all, like at startup before ensureMinServers is done
+	if err := as.scaleDown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := as.provisionServer(as.serverCreateOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	as.addServer(s)
+	defer as.deleteServers()
+
+	if err := as.scaleDown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := provider.Running(); n != 1 {
+		t.Fatalf("Expected the server to be kept with fewer than min servers, got %d", n)
+	}
+}
+
+func TestAdoptServersFromState(t *testing.T) {
+	opts := testOpts()
+	opts.StateDir = t.TempDir()
+	provider := fakeprovider.New()
+	ctx := context.Background()
+
+	before := NewWithProvider(opts, provider)
+	if err := before.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulates a restart, where the old autoscaler never got to delete its server
+	after := NewWithProvider(opts, provider)
+	if err := after.adoptServers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(after.servers); n != 1 {
+		t.Fatalf("Expected 1 server to be adopted, got %d", n)
+	}
+
+	if err := after.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := provider.Running(); n != 1 {
+		t.Fatalf("Expected adopted server to be reused, got %d servers", n)
+	}
+
+	conn, err := after.GetConnection(ctx, UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, "hello")
+}
+
+func TestCollectGarbage(t *testing.T) {
+	opts := testOpts()
+	provider := fakeprovider.New()
+	as := NewWithProvider(opts, provider)
+	ctx := context.Background()
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	orphaned := as.serverCreateOpts()
+	orphaned.Labels = map[string]string{instanceLabel: "crashed"}
+	if _, err := provider.CreateServer(ctx, orphaned); err != nil {
+		t.Fatal(err)
+	}
+	otherPrefix := as.serverCreateOpts()
+	otherPrefix.Name = "other-abcdef"
+	if _, err := provider.CreateServer(ctx, otherPrefix); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := as.collectGarbage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := provider.Running(); n != 2 {
+		t.Fatalf("Expected only the orphaned server to be deleted, got %d servers", n)
+	}
+	if n := len(as.servers); n != 1 {
+		t.Fatalf("Expected owned server to be kept, got %d servers in pool", n)
+	}
+
+	as.gc.MaxLifetime = time.Nanosecond
+
+	if err := as.collectGarbage(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(as.servers); n != 0 {
+		t.Fatalf("Expected expired server to be deleted, got %d servers in pool", n)
+	}
+	if n := provider.Running(); n != 1 {
+		t.Fatalf("Expected server with other prefix to be kept, got %d servers", n)
+	}
+}
+
+func TestDockerKeepalive(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	mu := sync.Mutex{}
+	running := "[{\"Id\": \"abc\"}]"
+	var filters string
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		filters = r.URL.Query().Get("filters")
+		io.WriteString(w, running)
+	}))
+
+	opts := testOpts()
+	opts.ScaledownAfter = 10 * time.Millisecond
+	opts.DockerKeepalive = &DockerKeepaliveOpts{
+		Socket:  socket,
+		Filters: map[string][]string{"label": {"keepalive"}},
+	}
+	provider := fakeprovider.New()
+	as := NewWithProvider(opts, provider)
+	ctx := context.Background()
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if err := as.evaluateScaledown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := provider.Running(); n != 1 {
+		t.Fatalf("Expected server running containers to be kept, got %d servers", n)
+	}
+	mu.Lock()
+	if filters != `{"label":["keepalive"]}` {
+		t.Errorf("Unexpected filters sent to docker api: %s", filters)
+	}
+	running = "[]"
+	mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := as.evaluateScaledown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := provider.Running(); n != 0 {
+		t.Fatalf("Expected server to be scaled down when containers stopped, got %d servers", n)
+	}
+}
+
+func TestDockerKeepaliveTimeout(t *testing.T) {
+	// Accepts connections, but never responds, like a wedged dockerd
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	opts := testOpts()
+	opts.ScaledownAfter = 10 * time.Millisecond
+	opts.DockerKeepalive = &DockerKeepaliveOpts{Socket: socket, Timeout: 200 * time.Millisecond}
+	provider := fakeprovider.New()
+	as := NewWithProvider(opts, provider)
+	ctx := context.Background()
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	if err := as.evaluateScaledown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("Expected the docker api to time out, took %s", d)
+	}
+	if n := provider.Running(); n != 0 {
+		t.Fatalf("Expected server to be scaled down when the docker api times out, got %d servers", n)
+	}
+}
+
+func TestReadinessProbes(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer httpServer.Close()
+
+	socket := filepath.Join(t.TempDir(), "ready.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	opts := testOpts()
+	opts.Readiness = []ProbeOpts{
+		{Type: "ssh", Retries: 2},
+		{Type: "tcp", Addr: startEchoServer(t)},
+		{Type: "unix", Addr: socket},
+		{Type: "http", URL: httpServer.URL, ExpectStatus: http.StatusTeapot},
+		{Type: "command", Command: "exit 3", ExpectExitCode: 3},
+	}
+	provider := fakeprovider.New()
+	as := NewWithProvider(opts, provider)
+
+	if err := as.ensureOnline(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := provider.Running(); n != 1 {
+		t.Fatalf("Expected 1 server running, got %d", n)
+	}
+}
+
+func TestFailingReadinessProbeDeletesServer(t *testing.T) {
+	opts := testOpts()
+	opts.Readiness = []ProbeOpts{
+		{Type: "command", Command: "exit 1", Retries: 3, Backoff: time.Millisecond, BackoffMultiplier: 2},
+	}
+	provider := fakeprovider.New()
+	as := NewWithProvider(opts, provider)
+
+	if err := as.ensureOnline(context.Background()); err == nil {
+		t.Fatal("Expected ensure online to fail when readiness probe fails")
+	}
+	if n := provider.Running(); n != 0 {
+		t.Fatalf("Expected server to be deleted, got %d servers", n)
+	}
+	if n := len(as.servers); n != 0 {
+		t.Fatalf("Expected no servers in pool, got %d", n)
+	}
+}
+
+func TestSharedSSHConnections(t *testing.T) {
+	opts := testOpts()
+	opts.SSH.MaxChannels = 2
+	opts.SSH.KeepaliveInterval = 10 * time.Millisecond
+	provider := fakeprovider.New()
+	as := NewWithProvider(opts, provider)
+	ctx := context.Background()
+	echo := UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)}
+
+	if err := as.ensureOnline(ctx); err != nil {
+		t.Fatal(err)
+	}
+	pool := as.servers[0].ssh
+
+	conns := []io.ReadWriteCloser{}
+	for i := 0; i < 3; i++ {
+		conn, err := as.GetConnection(ctx, echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	// Survives a few keepalive requests
+	time.Sleep(50 * time.Millisecond)
+	for _, conn := range conns {
+		assertEcho(t, conn, "hello")
+	}
+
+	pool.mu.Lock()
+	n := len(pool.conns)
+	broken := pool.conns[0]
+	pool.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("Expected 3 channels to share 2 ssh connections, got %d connections", n)
+	}
+
+	pool.remove(broken)
+
+	conn, err := as.GetConnection(ctx, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, "reconnected")
+}
+
+func TestSSHPoolUnresponsiveServer(t *testing.T) {
+	as := NewWithProvider(testOpts(), fakeprovider.New())
+
+	// Accepts connections, but never completes the ssh handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	pool := newSSHConnPool(as.sshClient, l.Addr().String(), as.sshOpts, 500*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := pool.Dial(ctx, "tcp", "127.0.0.1:22"); err == nil {
+		t.Fatal("Expected dial to fail")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected dial to give up when ctx is done, took %s", d)
+	}
+
+	// Others waiting for the connection give up on the connect timeout
+	if _, err := pool.Dial(context.Background(), "tcp", "127.0.0.1:22"); err == nil {
+		t.Fatal("Expected dial to fail")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Expected connecting to time out, took %s", d)
+	}
+
+	// Closing doesn't wait for connections being established
+	pool.Dial(ctx, "tcp", "127.0.0.1:22")
+	closed := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected close not to block on a connection being established")
+	}
+}
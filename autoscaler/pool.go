@@ -0,0 +1,175 @@
+package autoscaler
+
+import (
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// A server in the pool, with the state used to route connections to it and to decide
+// when it should be scaled down. Guarded by Autoscaler.mu.
+type poolServer struct {
+	server *Server
+	// Address of the ssh daemon on the server
+	addr string
+	// Shared ssh connections used to open the proxied connections
+	ssh *sshConnPool
+	// Set when the server last responded to ping, only healthy servers get new connections
+	// and count towards min_servers and max_servers
+	healthy bool
+	// Number of pings in a row the server hasn't responded to, it is deleted after
+	// maxFailedPings
+	failedPings int
+	// Last time the server was seen alive, by responding to ping or getting a new connection
+	lastSeen time.Time
+	// When the host certificate of the server should be renewed, in CA mode
+	hostCertRenewAt time.Time
+	// Draining servers don't get new connections, and are deleted when the open ones close
+	draining bool
+	// Number of open connections to the server
+	connections int
+	// Last time a connection to the server was opened or closed, or data flowed through
+	// one of them. Stored as unix nanoseconds, and accessed atomically as it is updated on
+	// every read and write.
+	lastActivity int64
+}
+
+func newPoolServer(server *Server, addr string, ssh *sshConnPool) *poolServer {
+	s := &poolServer{
+		server: server,
+		addr:   addr,
+		ssh:    ssh,
+	}
+	s.touch()
+	return s
+}
+
+func (s *poolServer) touch() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+func (s *poolServer) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActivity))
+}
+
+// Upstream connection that keeps track of when data last flowed through it, for itself
+// and for the server it is connected to.
+type trackedConn struct {
+	rwc          io.ReadWriteCloser
+	server       *poolServer
+	lastActivity int64
+}
+
+func newTrackedConn(rwc io.ReadWriteCloser, server *poolServer) *trackedConn {
+	c := &trackedConn{rwc: rwc, server: server}
+	c.touch()
+	return c
+}
+
+func (c *trackedConn) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	c.server.touch()
+}
+
+func (c *trackedConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+}
+
+func (c *trackedConn) Read(p []byte) (n int, err error) {
+	n, err = c.rwc.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (n int, err error) {
+	n, err = c.rwc.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	return c.rwc.Close()
+}
+
+// Returns the servers that aren't draining.
+func activeServers(servers []*poolServer) []*poolServer {
+	active := []*poolServer{}
+	for _, s := range servers {
+		if !s.draining {
+			active = append(active, s)
+		}
+	}
+	return active
+}
+
+// Returns the servers that aren't draining and responded to the last ping.
+func healthyServers(servers []*poolServer) []*poolServer {
+	healthy := []*poolServer{}
+	for _, s := range activeServers(servers) {
+		if s.healthy {
+			healthy = append(healthy, s)
+		}
+	}
+	return healthy
+}
+
+// Returns the servers that haven't responded to the last maxFailedPings pings.
+func failedServers(servers []*poolServer) []*poolServer {
+	failed := []*poolServer{}
+	for _, s := range servers {
+		if s.failedPings >= maxFailedPings {
+			failed = append(failed, s)
+		}
+	}
+	return failed
+}
+
+// Returns the draining servers that have no connections left.
+func drainedServers(servers []*poolServer) []*poolServer {
+	drained := []*poolServer{}
+	for _, s := range servers {
+		if s.draining && s.connections == 0 {
+			drained = append(drained, s)
+		}
+	}
+	return drained
+}
+
+// Returns the servers ordered by number of connections, fewest first.
+func sortedByConnections(servers []*poolServer) []*poolServer {
+	sorted := append([]*poolServer{}, servers...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].connections < sorted[j].connections
+	})
+	return sorted
+}
+
+// Returns the healthy server with the fewest connections, or nil if no server is healthy.
+func leastConnections(servers []*poolServer) *poolServer {
+	for _, s := range sortedByConnections(activeServers(servers)) {
+		if s.healthy {
+			return s
+		}
+	}
+	return nil
+}
+
+// Returns the servers that have been without connections for longer than after, the
+// one that has been so the longest first.
+func idleServers(servers []*poolServer, after time.Duration) []*poolServer {
+	idle := []*poolServer{}
+	for _, s := range servers {
+		if s.connections == 0 && time.Since(s.lastActive()) > after {
+			idle = append(idle, s)
+		}
+	}
+	sort.SliceStable(idle, func(i, j int) bool {
+		return idle[i].lastActive().Before(idle[j].lastActive())
+	})
+	return idle
+}
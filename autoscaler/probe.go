@@ -0,0 +1,257 @@
+package autoscaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type ProbeOpts struct {
+	// One of ssh, tcp, unix, http or command. The ssh probe connects to the server, and is
+	// always run first, the others are run from the server, over ssh, in order.
+	Type string `yaml:"type"`
+	// Address to dial for tcp and unix probes
+	Addr string `yaml:"addr"`
+	// Url to GET for http probes
+	URL string `yaml:"url"`
+	// Status code expected from http probes, defaults to 200
+	ExpectStatus int `yaml:"expect_status"`
+	// Command to run for command probes
+	Command string `yaml:"command"`
+	// Exit code expected from command probes, defaults to 0
+	ExpectExitCode int `yaml:"expect_exit_code"`
+
+	// Timeout of each attempt, defaults to 5s
+	Timeout time.Duration `yaml:"timeout"`
+	// Number of attempts before giving up, defaults to 6
+	Retries int `yaml:"retries"`
+	// Time to wait between attempts, defaults to 5s
+	Backoff time.Duration `yaml:"backoff"`
+	// Multiplies the time to wait after every attempt, defaults to 1
+	BackoffMultiplier float64 `yaml:"backoff_multiplier"`
+}
+
+func (o ProbeOpts) withDefaults() ProbeOpts {
+	if o.ExpectStatus == 0 {
+		o.ExpectStatus = http.StatusOK
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 5 * time.Second
+	}
+	if o.Retries == 0 {
+		o.Retries = 6
+	}
+	if o.Backoff == 0 {
+		o.Backoff = 5 * time.Second
+	}
+	if o.BackoffMultiplier == 0 {
+		o.BackoffMultiplier = 1
+	}
+	return o
+}
+
+func (o ProbeOpts) String() string {
+	switch o.Type {
+	case "tcp", "unix":
+		return fmt.Sprintf("%s %s", o.Type, o.Addr)
+	case "http":
+		return fmt.Sprintf("%s %s", o.Type, o.URL)
+	case "command":
+		return fmt.Sprintf("%s %s", o.Type, o.Command)
+	}
+	return o.Type
+}
+
+// Builds the list of probes to run when a server is created. The ssh probe is always first,
+// with the timing from the readiness list if it contains one. wait_for is run last, as a tcp
+// or unix probe.
+func readinessProbes(readiness []ProbeOpts, waitFor *UpstreamOpts) ([]ProbeOpts, error) {
+	sshProbe := ProbeOpts{Type: "ssh", Timeout: 4 * time.Second}
+	probes := []ProbeOpts{}
+
+	for _, probe := range readiness {
+		switch probe.Type {
+		case "ssh":
+			sshProbe = probe
+		case "tcp", "unix", "http", "command":
+			probes = append(probes, probe.withDefaults())
+		default:
+			return nil, fmt.Errorf("Unknown readiness probe type '%s'", probe.Type)
+		}
+	}
+	if waitFor != nil {
+		probes = append(probes, ProbeOpts{Type: waitFor.Net, Addr: waitFor.Addr}.withDefaults())
+	}
+
+	return append([]ProbeOpts{sshProbe.withDefaults()}, probes...), nil
+}
+
+// Runs attempt until it succeeds, at most Retries times, waiting between attempts.
+func (o ProbeOpts) retry(attempt func() error) error {
+	wait := o.Backoff
+	var err error
+	for i := 0; i < o.Retries; i++ {
+		if err = attempt(); err == nil {
+			return nil
+		}
+		log.WithError(err).WithField("probe", o.String()).Debug("Probe failed")
+		if i < o.Retries-1 {
+			time.Sleep(wait)
+			wait = time.Duration(float64(wait) * o.BackoffMultiplier)
+		}
+	}
+	return fmt.Errorf("Probe '%s' didn't pass: %w", o, err)
+}
+
+// The longest time retry can take
+func (o ProbeOpts) maxDuration() time.Duration {
+	total := time.Duration(0)
+	wait := o.Backoff
+	for i := 0; i < o.Retries; i++ {
+		total += o.Timeout
+		if i < o.Retries-1 {
+			total += wait
+			wait = time.Duration(float64(wait) * o.BackoffMultiplier)
+		}
+	}
+	return total
+}
+
+// The longest time a server can take to pass the readiness probes
+func readinessTimeout(probes []ProbeOpts) time.Duration {
+	total := time.Duration(0)
+	for _, probe := range probes {
+		total += probe.maxDuration()
+	}
+	return total
+}
+
+// Runs the probe once, from the server sshConn is connected to.
+func (o ProbeOpts) run(sshConn *ssh.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.Timeout)
+	defer cancel()
+
+	switch o.Type {
+	case "tcp", "unix":
+		conn, err := dialContext(ctx, sshConn, o.Type, o.Addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http":
+		client := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dialContext(ctx, sshConn, network, addr)
+				},
+			},
+		}
+		defer client.CloseIdleConnections()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.URL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != o.ExpectStatus {
+			return fmt.Errorf("Expected status %d, got %d", o.ExpectStatus, resp.StatusCode)
+		}
+		return nil
+	case "command":
+		session, err := sshConn.NewSession()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+
+		c := make(chan error, 1)
+		go func() {
+			c <- session.Run(o.Command)
+		}()
+
+		select {
+		case err = <-c:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		exitCode := 0
+		exitErr := &ssh.ExitError{}
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitStatus()
+		} else if err != nil {
+			return err
+		}
+		if exitCode != o.ExpectExitCode {
+			return fmt.Errorf("Expected exit code %d, got %d", o.ExpectExitCode, exitCode)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown probe type '%s'", o.Type)
+}
+
+// Dials addr from the server sshConn is connected to, giving up when ctx is done.
+func dialContext(ctx context.Context, sshConn *ssh.Client, network string, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	c := make(chan result, 1)
+	go func() {
+		conn, err := sshConn.Dial(network, addr)
+		c <- result{conn: conn, err: err}
+	}()
+
+	select {
+	case r := <-c:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-c; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Waits for the server at addr to pass the readiness probes. The ssh probe connects to the
+// server, and that connection is used to run the rest of the probes.
+func (as *Autoscaler) waitUntilReady(addr string, observeStage func(string)) error {
+	sshProbe, probes := as.readiness[0], as.readiness[1:]
+
+	var sshConn *ssh.Client
+	err := sshProbe.retry(func() error {
+		conn, err := as.sshClient.ConnectTimeout(addr, sshProbe.Timeout)
+		sshConn = conn
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer sshConn.Close()
+	observeStage("ssh")
+
+	if len(probes) == 0 {
+		return nil
+	}
+
+	for _, probe := range probes {
+		log.WithField("probe", probe.String()).Info("Waiting for readiness probe")
+		if err := probe.retry(func() error { return probe.run(sshConn) }); err != nil {
+			return err
+		}
+	}
+	observeStage("readiness")
+
+	return nil
+}
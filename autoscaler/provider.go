@@ -0,0 +1,34 @@
+package autoscaler
+
+import (
+	"context"
+
+	"github.com/JonasBak/autoscaler-proxy/cloud"
+)
+
+// The server types live in the cloud package, so that providers outside of the autoscaler,
+// like the fake provider the tests use, can implement Provider.
+type Server = cloud.Server
+type ServerCreateOpts = cloud.ServerCreateOpts
+
+// Provider is the interface the autoscaler uses to create and delete servers in
+// some cloud.
+type Provider interface {
+	// Creates a server and blocks until it has been started.
+	CreateServer(ctx context.Context, opts ServerCreateOpts) (*Server, error)
+	DeleteServer(ctx context.Context, server *Server) error
+	// Lists the servers having all of the given labels. An empty value matches any
+	// server having the label, regardless of its value.
+	ListServers(ctx context.Context, labels map[string]string) ([]*Server, error)
+	// Returns the address (host:port) the ssh daemon on the server can be reached at.
+	Address(server *Server) (string, error)
+}
+
+func newProvider(opts AutoscalerOpts) Provider {
+	switch opts.Provider {
+	case "", "hcloud":
+		return newHCloudProvider(opts)
+	}
+	log.WithField("provider", opts.Provider).Fatal("Unknown provider")
+	return nil
+}
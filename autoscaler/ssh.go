@@ -1,93 +1,334 @@
 package autoscaler
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"time"
 
+	"github.com/getsops/sops/v3/decrypt"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var RSA_KEY_BITS = 4096
 
+type keyType struct {
+	// Type of the public key, as returned by ssh.PublicKey.Type()
+	publicKeyType string
+	// Algorithm the client accepts for host keys of this type
+	hostKeyAlgorithm string
+	// Algorithm the client accepts for host certificates of this type
+	certAlgorithm string
+}
+
+// The types of keys that can be generated, named the same way as in cloud-init ssh_keys
+var keyTypes = map[string]keyType{
+	"rsa":     {publicKeyType: ssh.KeyAlgoRSA, hostKeyAlgorithm: ssh.KeyAlgoRSASHA512, certAlgorithm: ssh.CertAlgoRSASHA512v01},
+	"ecdsa":   {publicKeyType: ssh.KeyAlgoECDSA256, hostKeyAlgorithm: ssh.KeyAlgoECDSA256, certAlgorithm: ssh.CertAlgoECDSA256v01},
+	"ed25519": {publicKeyType: ssh.KeyAlgoED25519, hostKeyAlgorithm: ssh.KeyAlgoED25519, certAlgorithm: ssh.CertAlgoED25519v01},
+}
+
+// Returns the configured key type, defaulting to rsa.
+func (o SSHOpts) keyType() string {
+	if o.KeyType == "" {
+		return "rsa"
+	}
+	return o.KeyType
+}
+
 type SSHClient struct {
 	// Config set up to connect using publicKey to a server holding remoteKey
 	config ssh.ClientConfig
 	// Public key for the key used to authenticate to the server
 	publicKey ssh.PublicKey
 	// Private key (PEM) to be put on the server, only key that this client will
-	// accept when connecting.
+	// accept when connecting. Nil if the host key is pinned in the config instead
 	remoteKey []byte
+	// CA signing the certificates, nil if not in CA mode
+	ca *sshCA
+	// Jump host the connections go through, nil if the servers are connected to directly
+	jump *jumpHost
 }
 
-// Creates an SSHClient and generates a pair of rsa keys, one for the client
-// and one for the server that can be distributed using cloud-init.
-func newSSHClient() SSHClient {
-	log.Debug("Generating local ssh key")
-	key, err := generatePrivateKey()
-	if err != nil {
-		log.WithError(err).Fatal("Faled to generate local ssh key")
+// Creates an SSHClient and generates a pair of keys of the configured type, one for
+// the client and one for the server that can be distributed using cloud-init. If
+// stateDir is set, the keys are read from there if they have been generated before.
+// Instead of being generated, the client key can be read from a file or an ssh-agent,
+// and the host key can be pinned, if the servers are configured with known keys.
+func newSSHClient(stateDir string, opts SSHOpts) SSHClient {
+	if _, ok := keyTypes[opts.keyType()]; !ok {
+		log.WithField("key_type", opts.KeyType).Fatal("Unknown ssh key type")
 	}
-	signer, err := ssh.ParsePrivateKey(key)
+
+	log.Debug("Loading local ssh key")
+	signers, err := clientSigners(stateDir, opts)
 	if err != nil {
-		log.WithError(err).Fatal("Faled to parse local ssh key")
+		log.WithError(err).Fatal("Faled to load local ssh key")
 	}
 
-	log.Debug("Generating remote ssh key")
-	remoteKey, err := generatePrivateKey()
+	log.Debug("Loading remote ssh key")
+	hostKeyCallback, hostKeyAlgorithms, remoteKey, err := hostKeyVerification(stateDir, opts)
 	if err != nil {
-		log.WithError(err).Fatal("Faled to generate remote ssh key")
+		log.WithError(err).Fatal("Faled to load remote ssh key")
 	}
-	remoteSigner, err := ssh.ParsePrivateKey(remoteKey)
-	if err != nil {
-		log.WithError(err).Fatal("Faled to parse remote ssh key")
+
+	user := opts.User
+	if user == "" {
+		user = "autoscaler"
 	}
 
-	return SSHClient{
+	client := SSHClient{
 		config: ssh.ClientConfig{
-			User: "autoscaler",
+			User: user,
 			Auth: []ssh.AuthMethod{
-				ssh.PublicKeys(signer),
+				ssh.PublicKeys(signers...),
 			},
-			HostKeyCallback:   ssh.FixedHostKey(remoteSigner.PublicKey()),
-			HostKeyAlgorithms: []string{ssh.KeyAlgoRSASHA512},
+			HostKeyCallback:   hostKeyCallback,
+			HostKeyAlgorithms: hostKeyAlgorithms,
 		},
-		publicKey: signer.PublicKey(),
+		publicKey: signers[0].PublicKey(),
 		remoteKey: remoteKey,
 	}
+
+	if opts.CA.Enabled {
+		if err := client.useCA(stateDir, opts, signers[0]); err != nil {
+			log.WithError(err).Fatal("Failed to set up ssh certificate authority")
+		}
+	}
+
+	if opts.JumpHost.Addr != "" {
+		client.jump, err = newJumpHost(opts.JumpHost, user, signers)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid jump host")
+		}
+	}
+
+	return client
 }
 
-// Connect to sshAddr using credentials and configuration from the SSHClient
-func (c SSHClient) Connect(sshAddr string) (*ssh.Client, error) {
-	conn, err := ssh.Dial("tcp", sshAddr, &c.config)
+// Switches the client to authenticate with user certificates for signer, and to verify
+// hosts by their certificates. A host key is generated if needed, and signed.
+func (c *SSHClient) useCA(stateDir string, opts SSHOpts, signer ssh.Signer) error {
+	ca, err := newSSHCA(stateDir, opts)
+	if err != nil {
+		return err
+	}
+
+	if c.remoteKey == nil {
+		c.remoteKey, err = loadOrGeneratePrivateKey(stateDir, "server_key", opts.keyType())
+		if err != nil {
+			return err
+		}
+	}
+	remoteSigner, err := ssh.ParsePrivateKey(c.remoteKey)
+	if err != nil {
+		return err
+	}
+	ca.hostKey = remoteSigner.PublicKey()
+
+	c.ca = ca
+	c.config.Auth = []ssh.AuthMethod{
+		ssh.PublicKeysCallback((&certSigner{ca: ca, signer: signer, user: c.config.User}).Signers),
+	}
+	c.config.HostKeyCallback = ca.hostKeyCallback()
+	c.config.HostKeyAlgorithms = []string{keyTypes[opts.keyType()].certAlgorithm}
+
+	return nil
+}
+
+// Returns the keys the client authenticates with. They come from the ssh-agent, a file,
+// a sops encrypted file or are generated, in that order of precedence.
+func clientSigners(stateDir string, opts SSHOpts) ([]ssh.Signer, error) {
+	if opts.Agent {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+		}
+		// The connection is kept open, the agent is used every time the client connects
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, err
+		}
+		signers, err := agent.NewClient(conn).Signers()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if len(signers) == 0 {
+			conn.Close()
+			return nil, fmt.Errorf("No keys in ssh-agent")
+		}
+		return signers, nil
+	}
+
+	var key []byte
+	var err error
+	if opts.ClientKeyFile != "" {
+		key, err = os.ReadFile(opts.ClientKeyFile)
+	} else if opts.ClientKeyFrom != "" {
+		key, err = decrypt.File(opts.ClientKeyFrom, "binary")
+	} else {
+		key, err = loadOrGeneratePrivateKey(stateDir, "client_key", opts.keyType())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return conn, err
+	return []ssh.Signer{signer}, nil
 }
 
-func generatePrivateKey() ([]byte, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, RSA_KEY_BITS)
+// Returns how the host key of the servers is verified. If neither a known_hosts file nor
+// a host key is configured, a host key is generated and returned as PEM, so it can be
+// put on the servers.
+func hostKeyVerification(stateDir string, opts SSHOpts) (ssh.HostKeyCallback, []string, []byte, error) {
+	if opts.KnownHosts != "" || opts.HostKey != "" {
+		callback, algorithms, err := pinnedHostKey(opts.HostKey, opts.KnownHosts)
+		return callback, algorithms, nil, err
+	}
+
+	remoteKey, err := loadOrGeneratePrivateKey(stateDir, "server_key", opts.keyType())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	remoteSigner, err := ssh.ParsePrivateKey(remoteKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return ssh.FixedHostKey(remoteSigner.PublicKey()), hostKeyAlgorithms(remoteSigner.PublicKey().Type()), remoteKey, nil
+}
+
+// Returns how to verify a host with a known host key, either from a known_hosts file or a
+// single public key.
+func pinnedHostKey(hostKey string, knownHosts string) (ssh.HostKeyCallback, []string, error) {
+	if knownHosts != "" {
+		callback, err := knownhosts.New(knownHosts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return callback, nil, nil
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	return ssh.FixedHostKey(key), hostKeyAlgorithms(key.Type()), nil
+}
+
+// Returns the host key algorithms to accept for a host key of the given type
+func hostKeyAlgorithms(publicKeyType string) []string {
+	for _, kt := range keyTypes {
+		if kt.publicKeyType == publicKeyType {
+			return []string{kt.hostKeyAlgorithm}
+		}
+	}
+	return []string{publicKeyType}
+}
+
+// Connect to sshAddr using credentials and configuration from the SSHClient
+func (c SSHClient) Connect(sshAddr string) (*ssh.Client, error) {
+	return c.ConnectTimeout(sshAddr, 0)
+}
+
+// Connect to sshAddr, giving up if the connection isn't established within timeout. A
+// timeout of 0 means no timeout.
+func (c SSHClient) ConnectTimeout(sshAddr string, timeout time.Duration) (*ssh.Client, error) {
+	config := c.config
+	config.Timeout = timeout
+
+	conn, err := c.dial(sshAddr, timeout)
 	if err != nil {
 		return nil, err
 	}
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
 
-	err = privateKey.Validate()
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, sshAddr, &config)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// Opens a tcp connection to addr, through the jump host if there is one
+func (c SSHClient) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if c.jump != nil {
+		return c.jump.dial(addr, timeout)
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// Generates a private key of the given type, PEM encoded.
+func generatePrivateKey(keyType string) ([]byte, error) {
+	var privBlock *pem.Block
+
+	switch keyType {
+	case "rsa":
+		privateKey, err := rsa.GenerateKey(rand.Reader, RSA_KEY_BITS)
+		if err != nil {
+			return nil, err
+		}
+
+		err = privateKey.Validate()
+		if err != nil {
+			return nil, err
+		}
+
+		privBlock = &pem.Block{
+			Type:    "RSA PRIVATE KEY",
+			Headers: nil,
+			Bytes:   x509.MarshalPKCS1PrivateKey(privateKey),
+		}
+	case "ecdsa":
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		privDER, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
 
-	privDER := x509.MarshalPKCS1PrivateKey(privateKey)
+		privBlock = &pem.Block{
+			Type:    "EC PRIVATE KEY",
+			Headers: nil,
+			Bytes:   privDER,
+		}
+	case "ed25519":
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
 
-	privBlock := pem.Block{
-		Type:    "RSA PRIVATE KEY",
-		Headers: nil,
-		Bytes:   privDER,
+		privBlock, err = ssh.MarshalPrivateKey(privateKey, "")
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown key type '%s'", keyType)
 	}
 
-	privatePEM := pem.EncodeToMemory(&privBlock)
+	privatePEM := pem.EncodeToMemory(privBlock)
 
 	return privatePEM, nil
 }
@@ -0,0 +1,325 @@
+package autoscaler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type SSHOpts struct {
+	// User to connect as, defaults to autoscaler
+	User string `yaml:"user"`
+	// Port sshd listens on on the servers, defaults to 22
+	Port int `yaml:"port"`
+	// Ssh server to connect to the servers through, for servers that aren't reachable
+	// directly
+	JumpHost JumpHostOpts `yaml:"jump_host"`
+	// Type of the keys generated for the autoscaler and the servers, one of rsa, ecdsa and
+	// ed25519. Defaults to rsa
+	KeyType string `yaml:"key_type"`
+	// Authenticate with the keys in the ssh-agent listening on SSH_AUTH_SOCK instead of a
+	// generated key
+	Agent bool `yaml:"agent"`
+	// Path to a private key to authenticate with instead of a generated key
+	ClientKeyFile string `yaml:"client_key_file"`
+	// Path to a sops encrypted private key to authenticate with instead of a generated key
+	ClientKeyFrom string `yaml:"client_key_from"`
+	// Public key (authorized_keys format) the servers must present, instead of a generated
+	// host key distributed with cloud-init
+	HostKey string `yaml:"host_key"`
+	// Path to a known_hosts file used to verify the servers, instead of a generated host key
+	// distributed with cloud-init
+	KnownHosts string `yaml:"known_hosts"`
+	// Act as an ssh certificate authority instead of distributing keys
+	CA CAOpts `yaml:"ca"`
+	// How often to send keepalive requests on the connections to the servers, defaults to 30s
+	KeepaliveInterval time.Duration `yaml:"keepalive_interval"`
+	// Max number of channels (proxied connections) per ssh connection, another connection
+	// is opened when all are at the limit. Defaults to 64
+	MaxChannels int `yaml:"max_channels"`
+}
+
+// Long lived ssh connections to one server, shared by the connections proxied to it. The
+// connections are kept alive with keepalive requests, and broken connections are replaced
+// by new ones the next time a connection is needed.
+type sshConnPool struct {
+	client      SSHClient
+	addr        string
+	keepalive   time.Duration
+	maxChannels int
+	// How long to wait for a new ssh connection to be established
+	connectTimeout time.Duration
+
+	mu     sync.Mutex
+	conns  []*sharedSSHConn
+	closed bool
+}
+
+type sharedSSHConn struct {
+	// Set before ready is closed, nil if connecting failed
+	client *ssh.Client
+	// Set before ready is closed if connecting failed
+	err error
+	// Closed when the connection is established, or failed to be
+	ready chan struct{}
+	// Number of open and reserved channels, guarded by sshConnPool.mu
+	channels int
+	// Closed when the connection is broken
+	done chan struct{}
+	once sync.Once
+}
+
+// A channel on a shared connection, releases its slot on the connection when closed.
+type sharedSSHChannel struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *sharedSSHChannel) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func newSSHConnPool(client SSHClient, addr string, opts SSHOpts, connectTimeout time.Duration) *sshConnPool {
+	keepalive := opts.KeepaliveInterval
+	if keepalive == 0 {
+		keepalive = 30 * time.Second
+	}
+	maxChannels := opts.MaxChannels
+	if maxChannels == 0 {
+		maxChannels = 64
+	}
+
+	return &sshConnPool{
+		client:         client,
+		addr:           addr,
+		keepalive:      keepalive,
+		maxChannels:    maxChannels,
+		connectTimeout: connectTimeout,
+	}
+}
+
+// Creates the connection pool for the server at addr, giving up on new connections after
+// the timeout of the ssh probe.
+func (as *Autoscaler) newSSHConnPool(addr string) *sshConnPool {
+	return newSSHConnPool(as.sshClient, addr, as.sshOpts, as.readiness[0].Timeout)
+}
+
+// Opens a channel to addr on the server, on a connection with free capacity. Gives up when
+// ctx is done.
+func (p *sshConnPool) Dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	// A connection can break between being picked and being used, in that case
+	// retry once on a new connection
+	var err error
+	for i := 0; i < 2; i++ {
+		var conn *sharedSSHConn
+		conn, err = p.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var c net.Conn
+		c, err = dialContext(ctx, conn.client, network, addr)
+		if err == nil {
+			return &sharedSSHChannel{Conn: c, release: func() { p.release(conn) }}, nil
+		}
+		p.release(conn)
+
+		select {
+		case <-conn.done:
+			continue
+		default:
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// Reserves a channel on a connection with free capacity, connecting if there is none. The
+// connection is established without holding the lock, so a server that doesn't respond
+// doesn't block the rest of the pool, and the ones waiting for it give up when ctx is done.
+func (p *sshConnPool) acquire(ctx context.Context) (*sharedSSHConn, error) {
+	p.mu.Lock()
+
+	if p.closed {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("Connection pool is closed")
+	}
+
+	var conn *sharedSSHConn
+	for _, c := range p.conns {
+		if c.channels < p.maxChannels {
+			conn = c
+			break
+		}
+	}
+	if conn == nil {
+		log.WithField("addr", p.addr).WithField("connections", len(p.conns)+1).Debug("Opening ssh connection")
+
+		conn = &sharedSSHConn{
+			ready: make(chan struct{}),
+			done:  make(chan struct{}),
+		}
+		p.conns = append(p.conns, conn)
+
+		// Not tied to ctx, others can be waiting for the same connection
+		go p.connect(conn)
+	}
+	conn.channels++
+
+	p.mu.Unlock()
+
+	select {
+	case <-conn.ready:
+	case <-ctx.Done():
+		p.release(conn)
+		return nil, ctx.Err()
+	}
+	if conn.err != nil {
+		p.release(conn)
+		return nil, conn.err
+	}
+
+	return conn, nil
+}
+
+// Establishes conn, removing it from the pool if that fails
+func (p *sshConnPool) connect(conn *sharedSSHConn) {
+	client, err := p.client.ConnectTimeout(p.addr, p.connectTimeout)
+	if err != nil {
+		conn.err = err
+		close(conn.ready)
+		p.remove(conn)
+		return
+	}
+
+	conn.client = client
+	close(conn.ready)
+
+	go p.keepaliveLoop(conn)
+	go func() {
+		client.Wait()
+		p.remove(conn)
+	}()
+}
+
+// Runs command on the server with stdin as its input, and waits for it to exit. Gives up
+// when ctx is done.
+func (p *sshConnPool) Run(ctx context.Context, command string, stdin io.Reader) error {
+	conn, err := p.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.release(conn)
+
+	session, err := conn.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stderr := bytes.Buffer{}
+	session.Stdin = stdin
+	session.Stderr = &stderr
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(command)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *sshConnPool) release(conn *sharedSSHConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conn.channels--
+}
+
+// Removes a broken connection from the pool, so that it isn't used again.
+func (p *sshConnPool) remove(conn *sharedSSHConn) {
+	conn.once.Do(func() {
+		close(conn.done)
+		// The connection can still be connecting, it is closed once it is established
+		go func() {
+			<-conn.ready
+			if conn.client != nil {
+				conn.client.Close()
+			}
+		}()
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, c := range p.conns {
+		if c == conn {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			break
+		}
+	}
+}
+
+// Sends keepalive requests on conn until it breaks, or doesn't reply in time.
+func (p *sshConnPool) keepaliveLoop(conn *sharedSSHConn) {
+	ticker := time.NewTicker(p.keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-conn.done:
+			return
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := conn.client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case err := <-reply:
+			if err == nil {
+				continue
+			}
+			log.WithError(err).WithField("addr", p.addr).Warn("Keepalive failed, reconnecting")
+		case <-time.After(p.keepalive):
+			log.WithField("addr", p.addr).Warn("Keepalive timed out, reconnecting")
+		case <-conn.done:
+			return
+		}
+
+		p.remove(conn)
+		return
+	}
+}
+
+// Closes all connections, the pool can't be used after this.
+func (p *sshConnPool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	conns := append([]*sharedSSHConn{}, p.conns...)
+	p.mu.Unlock()
+
+	for _, conn := range conns {
+		p.remove(conn)
+	}
+}
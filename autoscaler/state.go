@@ -0,0 +1,196 @@
+package autoscaler
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/JonasBak/autoscaler-proxy/utils"
+	"golang.org/x/crypto/ssh"
+
+	"gopkg.in/yaml.v3"
+)
+
+// What is persisted in the state directory, besides the ssh keys, so that a restarted
+// autoscaler can adopt the servers created before the restart.
+type state struct {
+	InstanceID string        `yaml:"instance_id"`
+	Servers    []stateServer `yaml:"servers"`
+}
+
+type stateServer struct {
+	ID   string `yaml:"id"`
+	Name string `yaml:"name"`
+}
+
+// Reads the private key stored as name in stateDir, generating and storing a new one if it
+// doesn't exist, or isn't of the type keyType. If stateDir is empty a new key is generated
+// every time.
+func loadOrGeneratePrivateKey(stateDir string, name string, keyType string) ([]byte, error) {
+	if stateDir == "" {
+		return generatePrivateKey(keyType)
+	}
+
+	path := filepath.Join(stateDir, name)
+
+	key, err := os.ReadFile(path)
+	if err == nil {
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if signer.PublicKey().Type() == keyTypes[keyType].publicKeyType {
+			log.WithField("path", path).Debug("Using existing ssh key")
+			return key, nil
+		}
+		log.WithField("path", path).Warn("Existing ssh key is of another type, replacing it")
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err = generatePrivateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, writeFileAtomic(path, key)
+}
+
+// Reads the id of the instance from stateDir, generating and storing a new one if it doesn't
+// exist. If stateDir is empty a new id is generated every time.
+func loadOrGenerateInstanceID(stateDir string) (string, error) {
+	if stateDir == "" {
+		return utils.RandomString(8), nil
+	}
+
+	s, err := readState(stateDir)
+	if err != nil {
+		return "", err
+	}
+	if s.InstanceID != "" {
+		return s.InstanceID, nil
+	}
+
+	s.InstanceID = utils.RandomString(8)
+
+	return s.InstanceID, writeState(stateDir, s)
+}
+
+func readState(stateDir string) (state, error) {
+	s := state{}
+
+	file, err := os.ReadFile(filepath.Join(stateDir, "state.yml"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+
+	err = yaml.Unmarshal(file, &s)
+
+	return s, err
+}
+
+func writeState(stateDir string, s state) error {
+	d, err := yaml.Marshal(&s)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(stateDir, "state.yml"), d)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Writes the servers in the pool to the state directory. Should be called while holding mu.
+func (as *Autoscaler) saveState() {
+	if as.stateDir == "" {
+		return
+	}
+
+	s := state{InstanceID: as.instanceID, Servers: []stateServer{}}
+	for _, ps := range as.servers {
+		s.Servers = append(s.Servers, stateServer{ID: ps.server.ID, Name: ps.server.Name})
+	}
+
+	if err := writeState(as.stateDir, s); err != nil {
+		log.WithError(err).Error("Failed to save state")
+	}
+}
+
+// Looks up the servers from the state directory and adds the ones that still exist to
+// the pool. This version of the function should only be called from the goroutine
+// running Start().
+func (as *Autoscaler) adoptServers(ctx context.Context) error {
+	if as.stateDir == "" {
+		return nil
+	}
+
+	s, err := readState(as.stateDir)
+	if err != nil {
+		return err
+	}
+	if len(s.Servers) == 0 {
+		return nil
+	}
+
+	servers, err := as.provider.ListServers(ctx, nil)
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]*Server)
+	for _, server := range servers {
+		byID[server.ID] = server
+	}
+
+	for _, ss := range s.Servers {
+		log := log.WithField("server", ss.Name)
+
+		server, ok := byID[ss.ID]
+		if !ok {
+			log.Warn("Server from state no longer exists")
+			continue
+		}
+
+		addr, err := as.provider.Address(server)
+		if err != nil {
+			log.WithError(err).Error("Failed to get address of server from state")
+			continue
+		}
+
+		log.Info("Adopting server from state")
+
+		ps := newPoolServer(server, addr, as.newSSHConnPool(addr))
+		// Servers that don't respond are deleted if they keep failing to respond, see
+		// checkServers
+		if err := ping(as.sshClient.dial, 2, 2, 1, addr); err == nil {
+			ps.healthy = true
+			ps.lastSeen = time.Now()
+		} else {
+			log.WithError(err).Warn("Server from state didn't respond to ping")
+			ps.failedPings = 1
+		}
+
+		as.addServer(ps)
+	}
+
+	as.mu.Lock()
+	as.saveState()
+	as.mu.Unlock()
+
+	return nil
+}
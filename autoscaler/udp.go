@@ -0,0 +1,161 @@
+package autoscaler
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Ssh channels can't carry datagrams, so udp is forwarded by running this helper on the
+// server. It sends the datagrams it reads from stdin to the address given as arguments,
+// and writes the replies to stdout, each datagram prefixed with its length as two bytes.
+const udpHelper = `import os, socket, struct, sys, threading
+a = socket.getaddrinfo(sys.argv[1], int(sys.argv[2]), 0, socket.SOCK_DGRAM)[0]
+s = socket.socket(a[0], a[1])
+s.connect(a[4])
+i, o = sys.stdin.buffer, sys.stdout.buffer
+def up():
+    while True:
+        h = i.read(2)
+        if len(h) < 2:
+            os._exit(0)
+        d = i.read(struct.unpack(">H", h)[0])
+        try:
+            s.send(d)
+        except OSError:
+            pass
+threading.Thread(target=up, daemon=True).start()
+while True:
+    try:
+        d = s.recv(65535)
+    except OSError:
+        continue
+    o.write(struct.pack(">H", len(d)) + d)
+    o.flush()
+`
+
+// Returns the command running udpHelper, forwarding to addr
+func udpHelperCommand(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("python3 -c %s %s %s", shellQuote(udpHelper), shellQuote(host), shellQuote(port)), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Runs command in a session on a connection with free capacity, returning its stdin and
+// stdout as a stream.
+func (p *sshConnPool) Exec(ctx context.Context, command string) (io.ReadWriteCloser, error) {
+	conn, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := conn.client.NewSession()
+	if err != nil {
+		p.release(conn)
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		p.release(conn)
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		p.release(conn)
+		return nil, err
+	}
+	if err := session.Start(command); err != nil {
+		session.Close()
+		p.release(conn)
+		return nil, err
+	}
+
+	return &sessionStream{
+		Reader:  stdout,
+		Writer:  stdin,
+		session: session,
+		release: func() { p.release(conn) },
+	}, nil
+}
+
+type sessionStream struct {
+	io.Reader
+	io.Writer
+	session *ssh.Session
+	once    sync.Once
+	release func()
+}
+
+func (s *sessionStream) Close() error {
+	s.once.Do(s.release)
+	return s.session.Close()
+}
+
+// Carries datagrams over a stream to udpHelper. Every Write sends one datagram, and every
+// Read returns one datagram, truncated if it doesn't fit in the buffer like with udp.
+type datagramConn struct {
+	stream io.ReadWriteCloser
+
+	mu sync.Mutex
+}
+
+func (c *datagramConn) Read(p []byte) (int, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.stream, header); err != nil {
+		return 0, err
+	}
+	datagram := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(c.stream, datagram); err != nil {
+		return 0, err
+	}
+	return copy(p, datagram), nil
+}
+
+func (c *datagramConn) Write(p []byte) (int, error) {
+	if len(p) > 0xffff {
+		return 0, fmt.Errorf("Datagram too large")
+	}
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+
+	// One frame has to be written at once, even if there are multiple writers
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.stream.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *datagramConn) Close() error {
+	return c.stream.Close()
+}
+
+// Opens a udp "connection" to addr from the server, see datagramConn
+func (p *sshConnPool) DialUDP(ctx context.Context, addr string) (io.ReadWriteCloser, error) {
+	command, err := udpHelperCommand(addr)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := p.Exec(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	return &datagramConn{stream: stream}, nil
+}
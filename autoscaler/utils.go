@@ -6,16 +6,9 @@ import (
 	"time"
 )
 
-func ping(retries int, timeout int, wait int, addrPort string) error {
-	return pingConn(retries, wait, func() (net.Conn, error) {
-		timeout := time.Duration(time.Duration(timeout) * time.Second)
-		return net.DialTimeout("tcp", addrPort, timeout)
-	})
-}
-
-func pingConn(retries int, wait int, getConn func() (net.Conn, error)) error {
+func ping(dial func(string, time.Duration) (net.Conn, error), retries int, timeout int, wait int, addrPort string) error {
 	for i := 0; i < retries; i++ {
-		conn, err := getConn()
+		conn, err := dial(addrPort, time.Duration(timeout)*time.Second)
 		if err == nil {
 			conn.Close()
 			return nil
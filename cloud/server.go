@@ -0,0 +1,20 @@
+package cloud
+
+import "time"
+
+// A server created by a provider. Only the fields the autoscaler needs are exposed, the
+// provider keeps its own representation of the server in Raw.
+type Server struct {
+	ID      string
+	Name    string
+	Created time.Time
+	Labels  map[string]string
+
+	Raw interface{}
+}
+
+type ServerCreateOpts struct {
+	Name     string
+	UserData string
+	Labels   map[string]string
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	as "github.com/JonasBak/autoscaler-proxy/autoscaler"
@@ -12,7 +13,23 @@ import (
 )
 
 func DefaultConfig() proxy.ProxyOpts {
-	return proxy.ProxyOpts{
+	return defaultConfig(as.SSHOpts{KeyType: "rsa"})
+}
+
+// Default config where the cloud-init template distributes a server key of the configured
+// type, unless the host key of the servers is already known
+func defaultConfig(sshOpts as.SSHOpts) proxy.ProxyOpts {
+	keyType := sshOpts.KeyType
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	upper := strings.ToUpper(keyType)
+	user := sshOpts.User
+	if user == "" {
+		user = "autoscaler"
+	}
+
+	opts := proxy.ProxyOpts{
 		Autoscaler: as.AutoscalerOpts{
 			ConnectionTimeout: 10 * time.Minute,
 			ScaledownAfter:    15 * time.Minute,
@@ -21,17 +38,27 @@ func DefaultConfig() proxy.ProxyOpts {
 			ServerType:       "cpx31",
 			ServerImage:      "docker-ce",
 
+			MinServers:        0,
+			MaxServers:        1,
+			ScaleOutThreshold: 10,
+
+			// Opt-in, as proxies sharing a project and server name prefix would delete each
+			// other's servers
+			GC: as.GCOpts{
+				Interval: 0,
+			},
+
 			CloudInitTemplate: map[string]interface{}{
 				"groups":     []string{"docker"},
 				"ssh_pwauth": false,
 				"ssh_keys": map[string]string{
-					"rsa_private": "${SERVER_RSA_PRIVATE}",
-					"rsa_public":  "${SERVER_RSA_PUBLIC}",
+					keyType + "_private": fmt.Sprintf("${SERVER_%s_PRIVATE}", upper),
+					keyType + "_public":  fmt.Sprintf("${SERVER_%s_PUBLIC}", upper),
 				},
 				"users": []interface{}{
 					"default",
 					map[string]interface{}{
-						"name":                "autoscaler",
+						"name":                user,
 						"groups":              "users,docker",
 						"lock_passwd":         true,
 						"ssh_authorized_keys": []string{"${AUTOSCALER_AUTHORIZED_KEY}"},
@@ -39,9 +66,53 @@ func DefaultConfig() proxy.ProxyOpts {
 				},
 			},
 			CloudInitVariables: map[string]string{},
+
+			SSH: as.SSHOpts{
+				KeyType: keyType,
+			},
 		},
-		ListenAddr: map[string]as.UpstreamOpts{},
+		ListenAddr: map[string]proxy.ListenOpts{},
+	}
+
+	if sshOpts.CA.Enabled {
+		// The servers trust the CA instead of the key of the autoscaler, and get a host certificate
+		template := opts.Autoscaler.CloudInitTemplate
+		template["ssh_keys"].(map[string]string)[keyType+"_certificate"] = fmt.Sprintf("${SERVER_%s_CERTIFICATE}", upper)
+		template["write_files"] = []interface{}{
+			map[string]interface{}{
+				"path":    "/etc/ssh/sshd_config.d/autoscaler-ca.conf",
+				"content": "TrustedUserCAKeys /etc/ssh/autoscaler_ca.pub\n",
+			},
+			map[string]interface{}{
+				"path":    "/etc/ssh/autoscaler_ca.pub",
+				"content": "${SSH_CA_PUBLIC}",
+			},
+			// Installs the host certificates the autoscaler renews over ssh
+			map[string]interface{}{
+				"path":        "/usr/local/sbin/autoscaler-renew-host-cert",
+				"permissions": "0755",
+				"content": fmt.Sprintf(`#!/bin/sh
+set -e
+tmp=$(mktemp)
+trap 'rm -f "$tmp"' EXIT
+cat > "$tmp"
+ssh-keygen -L -f "$tmp" > /dev/null
+install -m 0644 "$tmp" /etc/ssh/ssh_host_%s_key-cert.pub
+systemctl reload ssh || systemctl reload sshd
+`, keyType),
+			},
+			map[string]interface{}{
+				"path":        "/etc/sudoers.d/autoscaler-renew-host-cert",
+				"permissions": "0440",
+				"content":     fmt.Sprintf("%s ALL=(root) NOPASSWD: /usr/local/sbin/autoscaler-renew-host-cert\n", user),
+			},
+		}
+		delete(template["users"].([]interface{})[1].(map[string]interface{}), "ssh_authorized_keys")
+	} else if sshOpts.HostKey != "" || sshOpts.KnownHosts != "" {
+		delete(opts.Autoscaler.CloudInitTemplate, "ssh_keys")
 	}
+
+	return opts
 }
 
 func patchProcsOpts(opts proxy.ProxyOpts) proxy.ProxyOpts {
@@ -64,6 +135,17 @@ func ParseConfigFile(path string) (proxy.ProxyOpts, error) {
 		return opts, err
 	}
 
+	// The default cloud-init template depends on the ssh config, so that has to be read first
+	sshOpts := struct {
+		Autoscaler struct {
+			SSH as.SSHOpts `yaml:"ssh"`
+		} `yaml:"autoscaler"`
+	}{}
+	if err := yaml.Unmarshal(file, &sshOpts); err != nil {
+		return opts, err
+	}
+	opts = defaultConfig(sshOpts.Autoscaler.SSH)
+
 	if err := yaml.Unmarshal(file, &opts); err != nil {
 		return opts, err
 	}
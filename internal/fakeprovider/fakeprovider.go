@@ -0,0 +1,443 @@
+package fakeprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JonasBak/autoscaler-proxy/cloud"
+	"github.com/JonasBak/autoscaler-proxy/utils"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+var log = utils.Logger().WithField("pkg", "fakeprovider")
+
+// Provider "creates" servers by starting an ssh server in process, listening on
+// localhost. The ssh server is configured from the cloud-init user data, so it only
+// accepts the host keys and authorized keys the autoscaler generated, and forwards
+// connections from the machine running the proxy. Only for tests, it runs commands and
+// opens connections on the machine running the proxy, which is why it lives in an internal
+// package instead of being built into the proxy.
+type Provider struct {
+	mu      sync.Mutex
+	nextID  int
+	servers map[string]*fakeServer
+}
+
+type fakeServer struct {
+	server   *cloud.Server
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// The parts of the cloud-init file the fake ssh server cares about
+type fakeCloudConfig struct {
+	SSHKeys    map[string]string `yaml:"ssh_keys"`
+	Users      []interface{}     `yaml:"users"`
+	WriteFiles []struct {
+		Path    string `yaml:"path"`
+		Content string `yaml:"content"`
+	} `yaml:"write_files"`
+}
+
+// Returns the user CA keys from the file referenced by a TrustedUserCAKeys option in one
+// of the written files, like sshd would with the files in place.
+func (c fakeCloudConfig) trustedUserCAKeys() ([]ssh.PublicKey, error) {
+	files := make(map[string]string)
+	for _, f := range c.WriteFiles {
+		files[f.Path] = f.Content
+	}
+
+	keys := []ssh.PublicKey{}
+	for _, content := range files {
+		for _, line := range strings.Split(content, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 || fields[0] != "TrustedUserCAKeys" {
+				continue
+			}
+			rest := []byte(files[fields[1]])
+			for len(rest) > 0 {
+				key, _, _, r, err := ssh.ParseAuthorizedKey(rest)
+				if err != nil {
+					return nil, err
+				}
+				keys = append(keys, key)
+				rest = r
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+type fakeDirectTCPIPMsg struct {
+	Raddr string
+	Rport uint32
+	Laddr string
+	Lport uint32
+}
+
+type fakeDirectStreamLocalMsg struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+func New() *Provider {
+	return &Provider{
+		servers: make(map[string]*fakeServer),
+	}
+}
+
+func (p *Provider) CreateServer(ctx context.Context, opts cloud.ServerCreateOpts) (*cloud.Server, error) {
+	config, err := fakeServerConfig(opts.UserData)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string)
+	for k, v := range opts.Labels {
+		labels[k] = v
+	}
+
+	p.mu.Lock()
+	p.nextID++
+	s := &fakeServer{
+		server: &cloud.Server{
+			ID:      strconv.Itoa(p.nextID),
+			Name:    opts.Name,
+			Created: time.Now(),
+			Labels:  labels,
+		},
+		listener: l,
+		config:   config,
+	}
+	p.servers[s.server.ID] = s
+	p.mu.Unlock()
+
+	go s.serve()
+
+	return s.server, nil
+}
+
+func (p *Provider) DeleteServer(ctx context.Context, server *cloud.Server) error {
+	p.mu.Lock()
+	s, ok := p.servers[server.ID]
+	delete(p.servers, server.ID)
+	p.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Server %s does not exist", server.ID)
+	}
+
+	s.close()
+
+	return nil
+}
+
+func (p *Provider) ListServers(ctx context.Context, labels map[string]string) ([]*cloud.Server, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result := []*cloud.Server{}
+SERVERS:
+	for _, s := range p.servers {
+		for k, v := range labels {
+			l, ok := s.server.Labels[k]
+			if !ok || (v != "" && l != v) {
+				continue SERVERS
+			}
+		}
+		result = append(result, s.server)
+	}
+
+	return result, nil
+}
+
+func (p *Provider) Address(server *cloud.Server) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.servers[server.ID]
+	if !ok {
+		return "", fmt.Errorf("Server %s does not exist", server.ID)
+	}
+
+	return s.listener.Addr().String(), nil
+}
+
+// Returns the number of servers currently running
+func (p *Provider) Running() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.servers)
+}
+
+// Stops the ssh daemon of server without deleting it, like a server that crashed
+func (p *Provider) Crash(server *cloud.Server) error {
+	p.mu.Lock()
+	s, ok := p.servers[server.ID]
+	p.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Server %s does not exist", server.ID)
+	}
+
+	s.close()
+
+	return nil
+}
+
+// Returns the number of connections the ssh server of server has accepted
+func (p *Provider) Accepted(server *cloud.Server) (int, error) {
+	p.mu.Lock()
+	s, ok := p.servers[server.ID]
+	p.mu.Unlock()
+
+	if !ok {
+		return 0, fmt.Errorf("Server %s does not exist", server.ID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns), nil
+}
+
+func fakeServerConfig(userData string) (*ssh.ServerConfig, error) {
+	cloudConfig := fakeCloudConfig{}
+	if err := yaml.Unmarshal([]byte(userData), &cloudConfig); err != nil {
+		return nil, err
+	}
+
+	authorizedKeys := make(map[string][]ssh.PublicKey)
+	for _, u := range cloudConfig.Users {
+		user, ok := u.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := user["name"].(string)
+		keys, _ := user["ssh_authorized_keys"].([]interface{})
+		for _, k := range keys {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fmt.Sprint(k)))
+			if err != nil {
+				return nil, err
+			}
+			authorizedKeys[name] = append(authorizedKeys[name], key)
+		}
+	}
+
+	userCAKeys, err := cloudConfig.trustedUserCAKeys()
+	if err != nil {
+		return nil, err
+	}
+	certChecker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, k := range userCAKeys {
+				if string(k.Marshal()) == string(auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if _, ok := key.(*ssh.Certificate); ok {
+				return certChecker.Authenticate(conn, key)
+			}
+			for _, k := range authorizedKeys[conn.User()] {
+				if string(k.Marshal()) == string(key.Marshal()) {
+					return &ssh.Permissions{}, nil
+				}
+			}
+			return nil, fmt.Errorf("Unknown public key for %s", conn.User())
+		},
+	}
+
+	hostKeys := 0
+	for name, key := range cloudConfig.SSHKeys {
+		if !strings.HasSuffix(name, "_private") {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := cloudConfig.SSHKeys[strings.TrimSuffix(name, "_private")+"_certificate"]; ok {
+			pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c))
+			if err != nil {
+				return nil, err
+			}
+			cert, ok := pub.(*ssh.Certificate)
+			if !ok {
+				return nil, fmt.Errorf("%s is not a certificate", name)
+			}
+			signer, err = ssh.NewCertSigner(cert, signer)
+			if err != nil {
+				return nil, err
+			}
+		}
+		config.AddHostKey(signer)
+		hostKeys++
+	}
+	if hostKeys == 0 {
+		return nil, fmt.Errorf("No host keys in cloud-init ssh_keys")
+	}
+
+	return config, nil
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+
+		go s.handleConn(conn)
+	}
+}
+
+func (s *fakeServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		log.WithError(err).Debug("Fake server rejected ssh connection")
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		var network, addr string
+
+		switch newChannel.ChannelType() {
+		case "session":
+			go handleSession(newChannel)
+			continue
+		case "direct-tcpip":
+			msg := fakeDirectTCPIPMsg{}
+			if err := ssh.Unmarshal(newChannel.ExtraData(), &msg); err != nil {
+				newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			network, addr = "tcp", net.JoinHostPort(msg.Raddr, strconv.Itoa(int(msg.Rport)))
+		case "direct-streamlocal@openssh.com":
+			msg := fakeDirectStreamLocalMsg{}
+			if err := ssh.Unmarshal(newChannel.ExtraData(), &msg); err != nil {
+				newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			network, addr = "unix", msg.SocketPath
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		go forwardChannel(newChannel, network, addr)
+	}
+}
+
+func forwardChannel(newChannel ssh.NewChannel, network string, addr string) {
+	upstream, err := net.Dial(network, addr)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer upstream.Close()
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	stop := make(chan struct{}, 2)
+
+	go func() {
+		io.Copy(upstream, channel)
+		stop <- struct{}{}
+	}()
+	go func() {
+		io.Copy(channel, upstream)
+		stop <- struct{}{}
+	}()
+
+	<-stop
+}
+
+// Handles exec requests by running the command locally, other requests are rejected.
+func handleSession(newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+
+		msg := struct{ Command string }{}
+		if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		cmd := exec.Command("/bin/sh", "-c", msg.Command)
+		cmd.Stdin = channel
+		cmd.Stdout = channel
+		cmd.Stderr = channel.Stderr()
+
+		status := 0
+		if err := cmd.Run(); err != nil {
+			exitErr := &exec.ExitError{}
+			if !errors.As(err, &exitErr) {
+				return
+			}
+			status = exitErr.ExitCode()
+		}
+
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+		return
+	}
+}
+
+func (s *fakeServer) close() {
+	s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "autoscaler_proxy"
+
+// Registry holding all the metrics of the proxy
+var Registry = prometheus.NewRegistry()
+
+var (
+	ConnectionsAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_accepted_total",
+		Help:      "Number of connections accepted, per listen addr.",
+	}, []string{"listen_addr"})
+
+	ConnectionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_rejected_total",
+		Help:      "Number of connections (or udp flows) rejected by the acl, per listen addr.",
+	}, []string{"listen_addr"})
+
+	BytesCopied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_copied_total",
+		Help:      "Number of bytes copied between clients and upstreams, per listen addr and direction (upstream or downstream).",
+	}, []string{"listen_addr", "direction"})
+
+	ScaleUpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scale_up_duration_seconds",
+		Help:      "Time spent creating a server, per stage (create, ssh, readiness and total).",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 9),
+	}, []string{"stage"})
+
+	EnsureOnlineFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ensure_online_failures_total",
+		Help:      "Number of times the autoscaler failed to make sure a server was online.",
+	})
+
+	ProcExits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "proc_exits_total",
+		Help:      "Number of times a process from procs has exited, per command and status (success or error).",
+	}, []string{"cmd", "status"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ConnectionsAccepted,
+		ConnectionsRejected,
+		BytesCopied,
+		ScaleUpDuration,
+		EnsureOnlineFailures,
+		ProcExits,
+	)
+}
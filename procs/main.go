@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"github.com/JonasBak/autoscaler-proxy/metrics"
 	"github.com/JonasBak/autoscaler-proxy/utils"
 	"io"
 	"os/exec"
@@ -93,8 +94,11 @@ func (p Procs) Run(ctx context.Context) {
 			log.Info("running command")
 			err = proc.p.Run()
 			if err != nil {
+				metrics.ProcExits.WithLabelValues(proc.rawCmd, "error").Inc()
 				log.WithError(err).Error("command exited with error")
 				ctx.Value("fatal").(chan struct{}) <- struct{}{}
+			} else {
+				metrics.ProcExits.WithLabelValues(proc.rawCmd, "success").Inc()
 			}
 		}()
 	}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+type ACLOpts struct {
+	// Client addresses (CIDR, or a single ip) allowed to connect, everyone if empty
+	Allow []string `yaml:"allow"`
+	// Client addresses rejected, even if they are allowed
+	Deny []string `yaml:"deny"`
+}
+
+type acl struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newACL(opts ACLOpts) (acl, error) {
+	allow, err := parsePrefixes(opts.Allow)
+	if err != nil {
+		return acl{}, err
+	}
+	deny, err := parsePrefixes(opts.Deny)
+	if err != nil {
+		return acl{}, err
+	}
+	return acl{allow: allow, deny: deny}, nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, len(cidrs))
+	for i, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, err
+			}
+			prefixes[i] = netip.PrefixFrom(addr, addr.BitLen())
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes[i] = prefix.Masked()
+	}
+	return prefixes, nil
+}
+
+// Whether a client at addr is allowed to connect. Clients without an ip address are only
+// allowed if there are no rules.
+func (a acl) allowed(addr net.Addr) bool {
+	if len(a.allow) == 0 && len(a.deny) == 0 {
+		return true
+	}
+
+	var ip netip.Addr
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, _ = netip.AddrFromSlice(addr.IP)
+	case *net.UDPAddr:
+		ip, _ = netip.AddrFromSlice(addr.IP)
+	}
+	if !ip.IsValid() {
+		return false
+	}
+	ip = ip.Unmap()
+
+	for _, prefix := range a.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, prefix := range a.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	as "github.com/JonasBak/autoscaler-proxy/autoscaler"
+)
+
+func TestACLAllowed(t *testing.T) {
+	a, err := newACL(ACLOpts{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.7"},
+		Deny:  []string{"10.0.1.0/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, expected := range map[string]bool{
+		"10.0.0.5":        true,
+		"10.0.1.5":        false,
+		"::ffff:10.0.0.5": true,
+		"192.0.2.7":       true,
+		"192.0.2.8":       false,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"198.51.100.1":    false,
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+		if allowed := a.allowed(addr); allowed != expected {
+			t.Errorf("Expected %s allowed to be %t", ip, expected)
+		}
+	}
+
+	if !(acl{}).allowed(&net.UnixAddr{Name: "@", Net: "unix"}) {
+		t.Error("Expected everyone to be allowed without rules")
+	}
+	if a.allowed(&net.UnixAddr{Name: "@", Net: "unix"}) {
+		t.Error("Expected clients without ip to be rejected when there are rules")
+	}
+
+	if _, err := newACL(ACLOpts{Allow: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("Expected invalid cidr to fail")
+	}
+}
+
+func TestACLRejectsBeforeScaleUp(t *testing.T) {
+	addr := freeAddr(t)
+	h := newHarness(t, ProxyOpts{
+		Autoscaler: testAutoscalerOpts(),
+		ListenAddr: map[string]ListenOpts{
+			addr: {
+				UpstreamOpts: as.UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)},
+				Listen:       ListenerOpts{ACL: ACLOpts{Deny: []string{"127.0.0.0/8"}}},
+			},
+		},
+	})
+
+	conn := h.dial()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected rejected connection to be closed, got %v", err)
+	}
+	if n := h.provider.Running(); n != 0 {
+		t.Fatalf("Expected no servers for a rejected client, got %d", n)
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	as "github.com/JonasBak/autoscaler-proxy/autoscaler"
+	"github.com/JonasBak/autoscaler-proxy/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type statusResponse struct {
+	Servers []as.ServerStatus `json:"servers"`
+	// Number of open connections per listen addr
+	Connections map[string]int64 `json:"connections"`
+}
+
+type actionResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+func (p Proxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		connections := make(map[string]int64)
+		for addr, n := range p.connections {
+			connections[addr] = atomic.LoadInt64(n)
+		}
+
+		writeJSON(w, http.StatusOK, statusResponse{
+			Servers:     p.as.Status(),
+			Connections: connections,
+		})
+	})
+	mux.Handle("/metrics", p.metricsHandler())
+	mux.HandleFunc("/scale-up", adminAction(p.as.EnsureOnline))
+	mux.HandleFunc("/scale-down", adminAction(p.as.ScaleDown))
+	mux.HandleFunc("/drain", adminAction(p.as.Drain))
+
+	return mux
+}
+
+// Serves the metrics from the metrics package, along with the ones read from the autoscaler.
+func (p Proxy) metricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "autoscaler_proxy",
+			Name:      "server_up_seconds_total",
+			Help:      "Total number of seconds servers have been running.",
+		}, p.as.UpSeconds),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "autoscaler_proxy",
+			Name:      "servers",
+			Help:      "Number of servers running.",
+		}, func() float64 {
+			return float64(len(p.as.Status()))
+		}),
+	)
+
+	return promhttp.HandlerFor(prometheus.Gatherers{metrics.Registry, registry}, promhttp.HandlerOpts{})
+}
+
+// Handler for POST requests that runs action and responds with the error, if any.
+func adminAction(action func(context.Context) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := action(r.Context()); err != nil {
+			writeJSON(w, http.StatusInternalServerError, actionResponse{Error: err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, actionResponse{})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Warn("Failed to write admin response")
+	}
+}
+
+// Serves the admin api at adminAddr until ctx is done.
+func (p Proxy) serveAdmin(ctx context.Context) {
+	log := log.WithField("admin_addr", p.adminAddr)
+
+	server := &http.Server{
+		Addr:    p.adminAddr,
+		Handler: p.adminHandler(),
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Info("Serving admin api")
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("Error serving admin api")
+	}
+}
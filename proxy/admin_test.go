@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method string, path string, v interface{}) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s responded with %d: %s", method, path, w.Code, w.Body.String())
+	}
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	opts := testAutoscalerOpts()
+	opts.ScaledownInterval = 20 * time.Millisecond
+	h := newHarness(t, ProxyOpts{Autoscaler: opts})
+	admin := h.proxy.adminHandler()
+
+	adminRequest(t, admin, http.MethodPost, "/scale-up", nil)
+	h.waitForRunning(1)
+
+	conn := h.dial()
+	assertEcho(t, conn, "hello")
+
+	status := statusResponse{}
+	adminRequest(t, admin, http.MethodGet, "/status", &status)
+	if len(status.Servers) != 1 || status.Servers[0].Connections != 1 {
+		t.Fatalf("Expected one server with one connection, got %+v", status.Servers)
+	}
+	if n := status.Connections[h.addr]; n != 1 {
+		t.Fatalf("Expected one connection at %s, got %d", h.addr, n)
+	}
+
+	// The server is in use, so it shouldn't be scaled down
+	adminRequest(t, admin, http.MethodPost, "/scale-down", nil)
+	h.waitForRunning(1)
+
+	adminRequest(t, admin, http.MethodPost, "/drain", nil)
+	adminRequest(t, admin, http.MethodGet, "/status", &status)
+	if len(status.Servers) != 1 || !status.Servers[0].Draining {
+		t.Fatalf("Expected server to be draining, got %+v", status.Servers)
+	}
+	conn.Close()
+	h.waitForRunning(0)
+
+	adminRequest(t, admin, http.MethodPost, "/scale-up", nil)
+	h.waitForRunning(1)
+	adminRequest(t, admin, http.MethodPost, "/scale-down", nil)
+	h.waitForRunning(0)
+}
+
+func TestMetrics(t *testing.T) {
+	h := newHarness(t, ProxyOpts{Autoscaler: testAutoscalerOpts()})
+
+	conn := h.dial()
+	assertEcho(t, conn, "hello")
+
+	w := httptest.NewRecorder()
+	h.proxy.adminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+
+	for _, expected := range []string{
+		fmt.Sprintf(`autoscaler_proxy_connections_accepted_total{listen_addr="%s"} 1`, h.addr),
+		fmt.Sprintf(`autoscaler_proxy_bytes_copied_total{direction="upstream",listen_addr="%s"} 5`, h.addr),
+		fmt.Sprintf(`autoscaler_proxy_bytes_copied_total{direction="downstream",listen_addr="%s"} 5`, h.addr),
+		`autoscaler_proxy_scale_up_duration_seconds_count{stage="total"}`,
+		`autoscaler_proxy_servers 1`,
+		`autoscaler_proxy_server_up_seconds_total`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain '%s'", expected)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+// Errors reported back to socks5 and http_connect clients
+var (
+	errDestinationNotAllowed = fmt.Errorf("Destination not allowed")
+	errUnsupportedRequest    = fmt.Errorf("Unsupported request")
+)
+
+// Reports back to the client whether the connection to its destination succeeded
+type connectedFunc func(err error) error
+
+// Checks dest (host:port) against patterns like *.internal:443 or 10.0.0.*:*, matched with
+// path.Match on the host and port separately.
+func destinationAllowed(patterns []string, dest string) bool {
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		patternHost, patternPort, err := net.SplitHostPort(pattern)
+		if err != nil {
+			continue
+		}
+		hostOk, _ := path.Match(patternHost, host)
+		portOk, _ := path.Match(patternPort, port)
+		if hostOk && portOk {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reads a socks5 CONNECT request, without authentication (RFC 1928).
+func socks5Handshake(conn net.Conn) (string, connectedFunc, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", nil, err
+	}
+	if header[0] != 5 {
+		return "", nil, fmt.Errorf("Unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", nil, err
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == 0
+	}
+	if !noAuth {
+		conn.Write([]byte{5, 0xff})
+		return "", nil, fmt.Errorf("Client doesn't support socks5 without authentication")
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return "", nil, err
+	}
+
+	connected := func(err error) error {
+		reply := byte(0)
+		switch err {
+		case nil:
+		case errDestinationNotAllowed:
+			reply = 2
+		case errUnsupportedRequest:
+			reply = 7
+		default:
+			reply = 5
+		}
+		_, werr := conn.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0})
+		return werr
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", nil, err
+	}
+	if request[0] != 5 {
+		return "", nil, fmt.Errorf("Unsupported socks version %d", request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", nil, err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", nil, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", nil, err
+		}
+		host = string(name)
+	case 4:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", nil, err
+		}
+		host = net.IP(ip).String()
+	default:
+		return "", connected, errUnsupportedRequest
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", nil, err
+	}
+
+	// Only CONNECT is supported
+	if request[1] != 1 {
+		return "", connected, errUnsupportedRequest
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), connected, nil
+}
+
+// A connection where some of the data has already been read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Reads an http CONNECT request, returning the connection to use from now on, as data
+// after the request might have been buffered.
+func httpConnectHandshake(conn net.Conn) (net.Conn, string, connectedFunc, error) {
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return conn, "", nil, err
+	}
+
+	connected := func(err error) error {
+		status := http.StatusOK
+		switch err {
+		case nil:
+		case errDestinationNotAllowed:
+			status = http.StatusForbidden
+		case errUnsupportedRequest:
+			status = http.StatusMethodNotAllowed
+		default:
+			status = http.StatusBadGateway
+		}
+		_, werr := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+		return werr
+	}
+
+	if req.Method != http.MethodConnect {
+		return conn, "", connected, errUnsupportedRequest
+	}
+
+	return bufferedConn{Conn: conn, r: r}, req.Host, connected, nil
+}
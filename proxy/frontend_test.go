@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	as "github.com/JonasBak/autoscaler-proxy/autoscaler"
+)
+
+func newFrontendHarness(t *testing.T, listenerType string, destinations []string) *harness {
+	return newHarness(t, ProxyOpts{
+		Autoscaler: testAutoscalerOpts(),
+		ListenAddr: map[string]ListenOpts{
+			freeAddr(t): {
+				UpstreamOpts: as.UpstreamOpts{},
+				Listen:       ListenerOpts{Type: listenerType, Destinations: destinations},
+			},
+		},
+	})
+}
+
+// Sends a socks5 CONNECT request for dest, returning the reply code
+func socks5Connect(t *testing.T, conn net.Conn, dest string) byte {
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		t.Fatal(err)
+	}
+	if method[1] != 0 {
+		t.Fatalf("Expected no authentication, got method %d", method[1])
+	}
+
+	req := []byte{5, 1, 0, 3, byte(len(host))}
+	req = append(req, host...)
+	req = binary.BigEndian.AppendUint16(req, uint16(p))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[1]
+}
+
+func TestSocks5(t *testing.T) {
+	echo := startEchoServer(t)
+	h := newFrontendHarness(t, "socks5", []string{"127.0.0.1:*"})
+
+	conn := h.dial()
+	if reply := socks5Connect(t, conn, echo); reply != 0 {
+		t.Fatalf("Expected socks5 reply 0, got %d", reply)
+	}
+	assertEcho(t, conn, "hello")
+	h.waitForRunning(1)
+}
+
+func TestHTTPConnect(t *testing.T) {
+	echo := startEchoServer(t)
+	h := newFrontendHarness(t, "http_connect", []string{"127.0.0.1:*"})
+
+	conn := h.dial()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo, echo)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	assertEcho(t, struct {
+		io.Reader
+		io.Writer
+	}{r, conn}, "hello")
+	h.waitForRunning(1)
+}
+
+func TestDisallowedDestinationDoesntScaleUp(t *testing.T) {
+	h := newFrontendHarness(t, "socks5", []string{"*.internal:443"})
+
+	conn := h.dial()
+	if reply := socks5Connect(t, conn, "127.0.0.1:22"); reply != 2 {
+		t.Fatalf("Expected socks5 reply 2 (not allowed), got %d", reply)
+	}
+	if n := h.provider.Running(); n != 0 {
+		t.Fatalf("Expected no servers for a disallowed destination, got %d", n)
+	}
+}
+
+func TestDestinationAllowed(t *testing.T) {
+	patterns := []string{"*.internal:443", "10.0.0.*:*", "localhost:2375"}
+
+	for dest, expected := range map[string]bool{
+		"registry.internal:443": true,
+		"registry.internal:80":  false,
+		"10.0.0.5:8080":         true,
+		"10.0.1.5:8080":         false,
+		"localhost:2375":        true,
+		"localhost":             false,
+	} {
+		if allowed := destinationAllowed(patterns, dest); allowed != expected {
+			t.Errorf("Expected %s allowed to be %t", dest, expected)
+		}
+	}
+}
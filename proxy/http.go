@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	as "github.com/JonasBak/autoscaler-proxy/autoscaler"
+	"github.com/JonasBak/autoscaler-proxy/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A route of an http listener, requests matching both the host and the path prefix are
+// forwarded to the upstream of the route.
+type RouteOpts struct {
+	// Host header to match, with shell style wildcards, e.g. *.example.com. Any host if empty
+	Host string `yaml:"host"`
+	// Path prefix to match, e.g. /app/. Any path if empty
+	PathPrefix string `yaml:"path_prefix"`
+	// Remove the path prefix before forwarding the request
+	StripPrefix     bool `yaml:"strip_prefix"`
+	as.UpstreamOpts `yaml:",inline"`
+}
+
+func (r RouteOpts) matches(req *http.Request) bool {
+	if r.Host != "" {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if ok, _ := path.Match(strings.ToLower(r.Host), strings.ToLower(host)); !ok {
+			return false
+		}
+	}
+	return strings.HasPrefix(req.URL.Path, r.PathPrefix)
+}
+
+// The routes of an http listener, in the order they are tried. The upstream of the listener
+// is used for requests not matching any route, if it is set.
+func (o ListenOpts) routes() []RouteOpts {
+	routes := append([]RouteOpts{}, o.Listen.Routes...)
+	if o.Addr != "" {
+		routes = append(routes, RouteOpts{UpstreamOpts: o.UpstreamOpts})
+	}
+	return routes
+}
+
+// What to answer requests to an http listener with while there is no server online
+type WarmingUpOpts struct {
+	// How long requests are held waiting for a server, before they are answered with the
+	// warming up page. They are answered right away if 0
+	MaxWait time.Duration `yaml:"max_wait"`
+	// Seconds clients are told to wait before trying again, defaults to 10
+	RetryAfter int `yaml:"retry_after"`
+	// Path to the html page to answer with, a short default page if empty
+	Page string `yaml:"page"`
+}
+
+func (o WarmingUpOpts) retryAfter() int {
+	if o.RetryAfter == 0 {
+		return 10
+	}
+	return o.RetryAfter
+}
+
+func (o WarmingUpOpts) page() ([]byte, error) {
+	if o.Page != "" {
+		return os.ReadFile(o.Page)
+	}
+	return []byte(fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head><meta http-equiv="refresh" content="%d"><title>Warming up</title></head>
+<body><h1>Warming up</h1><p>The server is starting, this page will reload in a moment.</p></body>
+</html>
+`, o.retryAfter())), nil
+}
+
+// Listener the connections of http listeners are handed to after the handshake, served by
+// an http.Server.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *connListener) deliver(ctx context.Context, conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	case <-ctx.Done():
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// The connection to an upstream used by the reverse proxy, counting the bytes copied
+type upstreamConn struct {
+	io.ReadWriteCloser
+	upstreamBytes   prometheus.Counter
+	downstreamBytes prometheus.Counter
+}
+
+func (c upstreamConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.downstreamBytes.Add(float64(n))
+	return n, err
+}
+
+func (c upstreamConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.upstreamBytes.Add(float64(n))
+	return n, err
+}
+
+func (c upstreamConn) LocalAddr() net.Addr {
+	return &net.UnixAddr{Name: "autoscaler", Net: "unix"}
+}
+
+func (c upstreamConn) RemoteAddr() net.Addr {
+	return &net.UnixAddr{Name: "autoscaler", Net: "unix"}
+}
+
+// Deadlines aren't supported by the connections from the autoscaler, the transport doesn't
+// need them
+func (c upstreamConn) SetDeadline(t time.Time) error      { return nil }
+func (c upstreamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c upstreamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Creates a reverse proxy forwarding to the upstream of route on the servers, adding the
+// X-Forwarded-* headers. WebSocket upgrades are handled by httputil.ReverseProxy.
+func (p Proxy) newReverseProxy(addr string, route RouteOpts) *httputil.ReverseProxy {
+	upstreamBytes := metrics.BytesCopied.WithLabelValues(addr, "upstream")
+	downstreamBytes := metrics.BytesCopied.WithLabelValues(addr, "downstream")
+	waitTimeout := p.listenAddr[addr].Listen.waitTimeout()
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			if err := p.waitForOnline(ctx, waitTimeout); err != nil {
+				return nil, err
+			}
+			conn, err := p.as.GetConnection(ctx, route.UpstreamOpts)
+			if err != nil {
+				return nil, err
+			}
+			return upstreamConn{
+				ReadWriteCloser: conn,
+				upstreamBytes:   upstreamBytes,
+				downstreamBytes: downstreamBytes,
+			}, nil
+		},
+		// Idle connections to the upstream count as connections to the server, and keep it
+		// from scaling down
+		IdleConnTimeout: 30 * time.Second,
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetXForwarded()
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = r.In.Host
+			if route.StripPrefix {
+				r.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.In.URL.Path, route.PathPrefix), "/")
+				r.Out.URL.RawPath = ""
+			}
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.WithField("remote_addr", r.RemoteAddr).WithError(err).Error("Failed to forward http request")
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// Serves the requests of the http listener at addr, with connections from handshake, and
+// forwards them to the first matching route. With warming_up, requests coming while there is
+// no server online are answered with the warming up page instead of waiting for the server.
+func (p Proxy) serveHTTP(ctx context.Context, addr string) {
+	log := log.WithField("addr", addr)
+
+	routes := p.listenAddr[addr].routes()
+	proxies := make([]*httputil.ReverseProxy, len(routes))
+	for i, route := range routes {
+		proxies[i] = p.newReverseProxy(addr, route)
+	}
+
+	warmingUp := p.listenAddr[addr].Listen.WarmingUp
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Keep track of the request, WebSocket connections are hijacked from the server and
+		// not waited for by Shutdown
+		p.wg.Add(1)
+		defer p.wg.Done()
+
+		atomic.AddInt64(p.connections[addr], 1)
+		defer atomic.AddInt64(p.connections[addr], -1)
+
+		if warmingUp != nil && !p.as.Online() && p.waitForOnline(r.Context(), warmingUp.MaxWait) != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(warmingUp.retryAfter()))
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(p.warmingUpPages[addr])
+			return
+		}
+
+		for i, route := range routes {
+			if route.matches(r) {
+				proxies[i].ServeHTTP(w, r)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: handshakeTimeout,
+	}
+
+	l := p.httpListeners[addr]
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	if err := server.Serve(l); !errors.Is(err, net.ErrClosed) {
+		log.WithError(err).Error("Error serving http")
+	}
+
+	// Wait for ongoing requests, and close the idle connections on both sides
+	server.Shutdown(context.Background())
+	for _, proxy := range proxies {
+		proxy.Transport.(*http.Transport).CloseIdleConnections()
+	}
+}
+
+// Checks the routes of an http listener
+func validateRoutes(opts ListenOpts) error {
+	routes := opts.routes()
+	if len(routes) == 0 {
+		return fmt.Errorf("http listeners need routes or an upstream")
+	}
+	for _, route := range routes {
+		if route.Net == "" || route.Addr == "" {
+			return fmt.Errorf("Route without an upstream net and addr")
+		}
+		if route.Net == "udp" {
+			return fmt.Errorf("Routes can't forward to udp upstreams")
+		}
+		if _, err := path.Match(route.Host, ""); err != nil {
+			return fmt.Errorf("Invalid host pattern '%s'", route.Host)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	as "github.com/JonasBak/autoscaler-proxy/autoscaler"
+)
+
+// Starts an http server answering with its name, the path and the forwarded headers, and
+// echoing on connections upgraded to the "echo" protocol.
+func startHTTPServer(t *testing.T, name string, addr string) string {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "echo" {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			rw.Flush()
+			io.Copy(conn, rw)
+			return
+		}
+		fmt.Fprintf(w, "%s %s %s %s", name, r.URL.Path, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Host"))
+	})}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	return l.Addr().String()
+}
+
+func newHTTPHarness(t *testing.T) *harness {
+	return newHarness(t, ProxyOpts{
+		Autoscaler: testAutoscalerOpts(),
+		ListenAddr: map[string]ListenOpts{
+			freeAddr(t): {
+				UpstreamOpts: as.UpstreamOpts{Net: "tcp", Addr: startHTTPServer(t, "default", "127.0.0.1:0")},
+				Listen: ListenerOpts{
+					Type: "http",
+					Routes: []RouteOpts{
+						{
+							Host:         "*.example.com",
+							PathPrefix:   "/api/",
+							StripPrefix:  true,
+							UpstreamOpts: as.UpstreamOpts{Net: "tcp", Addr: startHTTPServer(t, "api", "127.0.0.1:0")},
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+func httpRequest(t *testing.T, h *harness, host string, path string) (*http.Response, string) {
+	h.dial().Close()
+
+	req, err := http.NewRequest("GET", "http://"+h.addr+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+
+	client := http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+func httpGet(t *testing.T, h *harness, host string, path string) string {
+	_, body := httpRequest(t, h, host, path)
+	return body
+}
+
+func TestHTTPRouting(t *testing.T) {
+	h := newHTTPHarness(t)
+
+	for _, tc := range []struct {
+		host     string
+		path     string
+		expected string
+	}{
+		{"app.example.com", "/api/users", "api /users 127.0.0.1 app.example.com"},
+		{"app.example.com:8080", "/api/", "api / 127.0.0.1 app.example.com:8080"},
+		{"app.example.com", "/users", "default /users 127.0.0.1 app.example.com"},
+		{"example.org", "/api/users", "default /api/users 127.0.0.1 example.org"},
+	} {
+		if body := httpGet(t, h, tc.host, tc.path); body != tc.expected {
+			t.Errorf("Expected '%s' for %s%s, got '%s'", tc.expected, tc.host, tc.path, body)
+		}
+	}
+	h.waitForRunning(1)
+}
+
+func TestHTTPWebSocketUpgrade(t *testing.T) {
+	h := newHTTPHarness(t)
+
+	conn := h.dial()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: example.org\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected upgrade, got %s", res.Status)
+	}
+
+	assertEcho(t, struct {
+		io.Reader
+		io.Writer
+	}{r, conn}, "hello")
+}
+
+func TestRouteMatches(t *testing.T) {
+	route := RouteOpts{Host: "*.example.com", PathPrefix: "/app/"}
+	for url, expected := range map[string]bool{
+		"http://a.example.com/app/x":       true,
+		"http://A.Example.com:80/app/":     true,
+		"http://a.example.com/application": false,
+		"http://example.com/app/x":         false,
+		"http://a.example.org/app/x":       false,
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		if matches := route.matches(req); matches != expected {
+			t.Errorf("Expected %s to match %t", url, expected)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.org/", nil)
+	if !(RouteOpts{}).matches(req) {
+		t.Error("Expected empty route to match everything")
+	}
+}
+
+// Runs an http listener where the server isn't ready until the upstream is started
+func newWarmingUpHarness(t *testing.T, warmingUp WarmingUpOpts) (*harness, string) {
+	upstream := freeAddr(t)
+
+	autoscalerOpts := testAutoscalerOpts()
+	autoscalerOpts.Readiness = []as.ProbeOpts{
+		{Type: "tcp", Addr: upstream, Retries: 200, Backoff: 50 * time.Millisecond},
+	}
+
+	return newHarness(t, ProxyOpts{
+		Autoscaler: autoscalerOpts,
+		ListenAddr: map[string]ListenOpts{
+			freeAddr(t): {
+				UpstreamOpts: as.UpstreamOpts{Net: "tcp", Addr: upstream},
+				Listen:       ListenerOpts{Type: "http", WarmingUp: &warmingUp},
+			},
+		},
+	}), upstream
+}
+
+func TestHTTPWarmingUpPage(t *testing.T) {
+	h, upstream := newWarmingUpHarness(t, WarmingUpOpts{RetryAfter: 5})
+
+	res, body := httpRequest(t, h, "example.org", "/")
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected warming up page while the server is created, got %s", res.Status)
+	}
+	if res.Header.Get("Retry-After") != "5" || !strings.Contains(body, "Warming up") {
+		t.Fatalf("Expected warming up page with Retry-After, got %v '%s'", res.Header, body)
+	}
+
+	startHTTPServer(t, "default", upstream)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		res, body := httpRequest(t, h, "example.org", "/")
+		if res.StatusCode == http.StatusOK {
+			if body != "default / 127.0.0.1 example.org" {
+				t.Fatalf("Unexpected body '%s'", body)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected request to be proxied when the server is ready, got %s", res.Status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestHTTPWarmingUpHold(t *testing.T) {
+	h, upstream := newWarmingUpHarness(t, WarmingUpOpts{MaxWait: 20 * time.Second})
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		startHTTPServer(t, "default", upstream)
+	}()
+
+	res, body := httpRequest(t, h, "example.org", "/")
+	if res.StatusCode != http.StatusOK || body != "default / 127.0.0.1 example.org" {
+		t.Fatalf("Expected request to be held until the server is ready, got %s '%s'", res.Status, body)
+	}
+}
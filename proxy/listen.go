@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	as "github.com/JonasBak/autoscaler-proxy/autoscaler"
+	"github.com/JonasBak/autoscaler-proxy/metrics"
+)
+
+// One entry in listen_addr, the upstream connections are forwarded to, and how to listen
+// for them.
+type ListenOpts struct {
+	as.UpstreamOpts `yaml:",inline"`
+	// Send a PROXY protocol header (v1 or v2) to the upstream, with the address of the
+	// client. Disabled if empty
+	ProxyProtocol string       `yaml:"proxy_protocol"`
+	Listen        ListenerOpts `yaml:"listen"`
+}
+
+type ListenerOpts struct {
+	// Network to listen on, tcp (default), unix or udp
+	Net string `yaml:"net"`
+	// Set to socks5 or http_connect to let the clients choose where to connect, instead of
+	// forwarding to the upstream of the listener, or to http to forward requests by routes.
+	// Not supported for udp
+	Type string `yaml:"type"`
+	// Routes of http listeners, the first matching route is used. Requests not matching any
+	// route go to the upstream of the listener if it is set
+	Routes []RouteOpts `yaml:"routes"`
+	// Answer requests to http listeners with a warming up page while the server is being
+	// created, instead of keeping them waiting
+	WarmingUp *WarmingUpOpts `yaml:"warming_up"`
+	// Destinations (host:port patterns) clients of socks5 and http_connect listeners are
+	// allowed to connect to, e.g. *.internal:443. Nothing is allowed if empty
+	Destinations []string `yaml:"destinations"`
+	// File mode of the unix socket, e.g. 0660. Left as created if 0
+	Mode fs.FileMode `yaml:"mode"`
+	// Owner of the unix socket, as user, user:group or :group, names or ids
+	Owner string `yaml:"owner"`
+	// Terminate tls, optionally requiring client certificates. Not supported for udp
+	TLS *TLSOpts `yaml:"tls"`
+	// Which client addresses are allowed to connect, checked before anything else. Clients
+	// of unix sockets are rejected if any rules are set
+	ACL ACLOpts `yaml:"acl"`
+	// Expect a PROXY protocol (v1 or v2) header from a load balancer at the start of every
+	// connection, with the address of the client. Not supported for udp
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// Addresses (CIDR, or a single ip) of the load balancers trusted to send PROXY headers,
+	// connections from anywhere else are rejected. Required for tcp listeners, clients of
+	// unix sockets are trusted by the mode and owner of the socket
+	ProxyProtocolFrom []string `yaml:"proxy_protocol_from"`
+	// How long a udp flow can go without datagrams in either direction before it is closed,
+	// defaults to 1m
+	UDPIdleTimeout time.Duration `yaml:"udp_idle_timeout"`
+	// How long connections wait for a server to come online before they are closed,
+	// defaults to 5m
+	WaitTimeout time.Duration `yaml:"wait_timeout"`
+}
+
+type TLSOpts struct {
+	// Paths to the certificate and key (PEM) of the listener
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Path to the CA (PEM) client certificates have to be signed by. Clients don't need
+	// certificates if empty
+	ClientCA string `yaml:"client_ca"`
+}
+
+// How long a client has to complete the tls handshake, and tell where it wants to connect
+const handshakeTimeout = 10 * time.Second
+
+// Listeners where something has to happen after accepting a connection, before it can be
+// forwarded.
+func (o ListenerOpts) needsHandshake() bool {
+	return o.TLS != nil || o.Type != "" || o.ProxyProtocol
+}
+
+func (o ListenerOpts) network() string {
+	if o.Net == "" {
+		return "tcp"
+	}
+	return o.Net
+}
+
+func (o ListenerOpts) waitTimeout() time.Duration {
+	if o.WaitTimeout == 0 {
+		return 5 * time.Minute
+	}
+	return o.WaitTimeout
+}
+
+func (o ListenerOpts) udpIdleTimeout() time.Duration {
+	if o.UDPIdleTimeout == 0 {
+		return time.Minute
+	}
+	return o.UDPIdleTimeout
+}
+
+// Listens at addr as configured by opts. Tls and the PROXY header are left to handshake.
+func listen(ctx context.Context, addr string, opts ListenerOpts) (net.Listener, error) {
+	switch opts.network() {
+	case "tcp":
+		return (&net.ListenConfig{}).Listen(ctx, "tcp", addr)
+	case "unix":
+		return listenUnix(ctx, addr, opts)
+	default:
+		return nil, fmt.Errorf("Unsupported listen network '%s'", opts.Net)
+	}
+}
+
+func (o TLSOpts) config() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if o.ClientCA != "" {
+		pem, err := os.ReadFile(o.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in %s", o.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// Reads the PROXY header and checks the acl, completes the tls handshake, and for socks5 and
+// http_connect listeners reads where the client wants to connect and checks that it is
+// allowed. Sends the connection on to be handled if everything succeeds, so servers aren't
+// scaled up for clients that are turned away. Connections to http listeners are handed to
+// their http server instead.
+func (p Proxy) handshake(ctx context.Context, addr string, conn net.Conn, c chan newConnectionCallback) {
+	log := log.WithField("remote_addr", conn.RemoteAddr().String())
+	listenOpts := p.listenAddr[addr].Listen
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	if listenOpts.ProxyProtocol {
+		proxyConn, err := readProxyHeader(conn)
+		if err != nil {
+			log.WithError(err).Warn("Failed to read PROXY header")
+			conn.Close()
+			return
+		}
+		conn = proxyConn
+		log = log.WithField("remote_addr", conn.RemoteAddr().String())
+
+		// The acl can't be checked before the address of the client is known
+		if !p.acls[addr].allowed(conn.RemoteAddr()) {
+			log.Warn("Client not allowed by acl, rejecting")
+			metrics.ConnectionsRejected.WithLabelValues(addr).Inc()
+			conn.Close()
+			return
+		}
+	}
+
+	if tlsConfig := p.tlsConfigs[addr]; tlsConfig != nil {
+		tlsConn := tls.Server(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			log.WithError(err).Warn("Tls handshake failed")
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+
+	// Requests are read, and routed, by the http server
+	if listenOpts.Type == "http" {
+		conn.SetDeadline(time.Time{})
+		p.httpListeners[addr].deliver(ctx, conn)
+		return
+	}
+
+	upstream := p.listenAddr[addr].UpstreamOpts
+	var connected connectedFunc
+
+	if listenOpts.Type != "" {
+		var dest string
+		var err error
+		switch listenOpts.Type {
+		case "socks5":
+			dest, connected, err = socks5Handshake(conn)
+		case "http_connect":
+			conn, dest, connected, err = httpConnectHandshake(conn)
+		}
+		if err != nil {
+			log.WithError(err).Debug("Handshake failed")
+			if connected != nil {
+				connected(err)
+			}
+			conn.Close()
+			return
+		}
+
+		if !destinationAllowed(listenOpts.Destinations, dest) {
+			log.WithField("destination", dest).Warn("Destination not allowed")
+			connected(errDestinationNotAllowed)
+			conn.Close()
+			return
+		}
+
+		upstream = as.UpstreamOpts{Net: "tcp", Addr: dest}
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	select {
+	case c <- newConnectionCallback{
+		addr:      addr,
+		conn:      conn,
+		upstream:  upstream,
+		connected: connected,
+	}:
+	case <-ctx.Done():
+		conn.Close()
+	}
+}
+
+// Listens at the unix socket path, replacing a stale socket left behind by a previous run.
+// The socket is removed when the listener is closed.
+func listenUnix(ctx context.Context, path string, opts ListenerOpts) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	l, err := (&net.ListenConfig{}).Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Mode != 0 {
+		if err := os.Chmod(path, opts.Mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	if opts.Owner != "" {
+		uid, gid, err := lookupOwner(opts.Owner)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		if err := os.Lchown(path, uid, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Parses owner as user, user:group or :group, returning -1 for the parts not set
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, _ := strings.Cut(owner, ":")
+
+	uid, gid := -1, -1
+
+	if userName != "" {
+		id, err := strconv.Atoi(userName)
+		if err != nil {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return 0, 0, err
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		uid = id
+	}
+
+	if groupName != "" {
+		id, err := strconv.Atoi(groupName)
+		if err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, err
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		gid = id
+	}
+
+	return uid, gid, nil
+}
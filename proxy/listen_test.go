@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	as "github.com/JonasBak/autoscaler-proxy/autoscaler"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Creates a certificate signed by parent, or self signed if parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert, template x509.Certificate) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := &template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key}
+}
+
+// Writes the certificate and key as PEM files, returning their paths
+func (c *testCert) write(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certPath, keyPath
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	server := newTestCert(t, "server", ca, x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	client := newTestCert(t, "client", ca, x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	certPath, keyPath := server.write(t)
+	caPath, _ := ca.write(t)
+
+	addr := freeAddr(t)
+	h := newHarness(t, ProxyOpts{
+		Autoscaler: testAutoscalerOpts(),
+		ListenAddr: map[string]ListenOpts{
+			addr: {
+				UpstreamOpts: as.UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)},
+				Listen: ListenerOpts{TLS: &TLSOpts{
+					Cert:     certPath,
+					Key:      keyPath,
+					ClientCA: caPath,
+				}},
+			},
+		},
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// Without a client certificate the handshake fails, and nothing is scaled up
+	conn := tls.Client(h.dial(), &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err == nil {
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("Expected connection without client certificate to fail")
+		}
+	}
+	if n := h.provider.Running(); n != 0 {
+		t.Fatalf("Expected no servers for a rejected client, got %d", n)
+	}
+
+	conn = tls.Client(h.dial(), &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "127.0.0.1",
+		Certificates: []tls.Certificate{client.tlsCertificate()},
+	})
+	assertEcho(t, conn, "hello")
+	h.waitForRunning(1)
+}
@@ -2,12 +2,15 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	as "github.com/JonasBak/autoscaler-proxy/autoscaler"
+	"github.com/JonasBak/autoscaler-proxy/metrics"
 	"github.com/JonasBak/autoscaler-proxy/procs"
 	"github.com/JonasBak/autoscaler-proxy/utils"
 )
@@ -17,29 +20,133 @@ var log = utils.Logger().WithField("pkg", "proxy")
 type newConnectionCallback struct {
 	addr string
 	conn net.Conn
+	// Where to forward the connection
+	upstream as.UpstreamOpts
+	// Tells the client if the upstream connection succeeded, nil for plain listeners
+	connected connectedFunc
 }
 
 type ProxyOpts struct {
-	Autoscaler as.AutoscalerOpts          `yaml:"autoscaler"`
-	ListenAddr map[string]as.UpstreamOpts `yaml:"listen_addr"`
-	Procs      procs.ProcsOpts            `yaml:"procs"`
+	Autoscaler as.AutoscalerOpts     `yaml:"autoscaler"`
+	ListenAddr map[string]ListenOpts `yaml:"listen_addr"`
+	Procs      procs.ProcsOpts       `yaml:"procs"`
+	// Address to serve the admin api at, disabled if empty
+	AdminAddr string `yaml:"admin_addr"`
 }
 
 type Proxy struct {
-	as         as.Autoscaler
-	listenAddr map[string]as.UpstreamOpts
+	as         *as.Autoscaler
+	listenAddr map[string]ListenOpts
 	procs      procs.Procs
+	adminAddr  string
+	// Number of open connections per listen addr
+	connections map[string]*int64
+	// Which clients are allowed to connect, per listen addr
+	acls map[string]acl
+	// Which load balancers are trusted to send PROXY headers, per listen addr
+	proxyProtocolFrom map[string]acl
+	// Tls config per listen addr, for the listeners terminating tls
+	tlsConfigs map[string]*tls.Config
+	// Where the connections of http listeners go after the handshake, per listen addr
+	httpListeners map[string]*connListener
+	// Warming up page per listen addr, for the http listeners with warming_up
+	warmingUpPages map[string][]byte
+	// Brings servers online in the background, shared by the connections waiting for one
+	online *onlineWaiter
 	// Used to keep track of ongoing connections, and wait for them to close when
 	// stopping the proxy.
 	wg *sync.WaitGroup
 }
 
 func New(opts ProxyOpts) Proxy {
+	return NewWithAutoscaler(opts, as.New(opts.Autoscaler))
+}
+
+// Creates a proxy using an already created autoscaler, opts.Autoscaler is ignored.
+func NewWithAutoscaler(opts ProxyOpts, autoscaler *as.Autoscaler) Proxy {
+	connections := make(map[string]*int64)
+	acls := make(map[string]acl)
+	proxyProtocolFrom := make(map[string]acl)
+	tlsConfigs := make(map[string]*tls.Config)
+	httpListeners := make(map[string]*connListener)
+	warmingUpPages := make(map[string][]byte)
+	for addr, listenOpts := range opts.ListenAddr {
+		connections[addr] = new(int64)
+
+		a, err := newACL(listenOpts.Listen.ACL)
+		if err != nil {
+			log.WithError(err).WithField("addr", addr).Fatal("Invalid acl")
+		}
+		acls[addr] = a
+
+		if listenOpts.Listen.ProxyProtocol {
+			if listenOpts.Listen.network() == "tcp" && len(listenOpts.Listen.ProxyProtocolFrom) == 0 {
+				log.WithField("addr", addr).Fatal("proxy_protocol needs proxy_protocol_from, the load balancers trusted to send the header")
+			}
+			from, err := newACL(ACLOpts{Allow: listenOpts.Listen.ProxyProtocolFrom})
+			if err != nil {
+				log.WithError(err).WithField("addr", addr).Fatal("Invalid proxy_protocol_from")
+			}
+			proxyProtocolFrom[addr] = from
+		}
+
+		if listenOpts.Listen.TLS != nil {
+			c, err := listenOpts.Listen.TLS.config()
+			if err != nil {
+				log.WithError(err).WithField("addr", addr).Fatal("Invalid tls config")
+			}
+			tlsConfigs[addr] = c
+		}
+
+		switch listenOpts.Listen.Type {
+		case "", "socks5", "http_connect":
+		case "http":
+			if err := validateRoutes(listenOpts); err != nil {
+				log.WithError(err).WithField("addr", addr).Fatal("Invalid http listener")
+			}
+			if listenOpts.ProxyProtocol != "" {
+				log.WithField("addr", addr).Fatal("http listeners send the address of the client in X-Forwarded-For, not PROXY protocol")
+			}
+			httpListeners[addr] = newConnListener(&net.TCPAddr{})
+
+			if listenOpts.Listen.WarmingUp != nil {
+				page, err := listenOpts.Listen.WarmingUp.page()
+				if err != nil {
+					log.WithError(err).WithField("addr", addr).Fatal("Failed to read warming up page")
+				}
+				warmingUpPages[addr] = page
+			}
+		default:
+			log.WithField("addr", addr).WithField("type", listenOpts.Listen.Type).Fatal("Unknown listener type")
+		}
+		if listenOpts.Listen.WarmingUp != nil && listenOpts.Listen.Type != "http" {
+			log.WithField("addr", addr).Fatal("warming_up is only supported for http listeners")
+		}
+		switch listenOpts.ProxyProtocol {
+		case "", "v1", "v2":
+		default:
+			log.WithField("addr", addr).WithField("proxy_protocol", listenOpts.ProxyProtocol).Fatal("Unknown PROXY protocol version")
+		}
+		if listenOpts.Listen.network() == "udp" && (listenOpts.Listen.needsHandshake() || listenOpts.ProxyProtocol != "") {
+			log.WithField("addr", addr).Fatal("udp listeners don't support tls, socks5, http_connect or PROXY protocol")
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+
 	return Proxy{
-		as:         as.New(opts.Autoscaler),
-		listenAddr: opts.ListenAddr,
-		procs:      procs.New(opts.Procs),
-		wg:         &sync.WaitGroup{},
+		as:                autoscaler,
+		listenAddr:        opts.ListenAddr,
+		procs:             procs.New(opts.Procs),
+		adminAddr:         opts.AdminAddr,
+		connections:       connections,
+		acls:              acls,
+		proxyProtocolFrom: proxyProtocolFrom,
+		tlsConfigs:        tlsConfigs,
+		httpListeners:     httpListeners,
+		warmingUpPages:    warmingUpPages,
+		online:            newOnlineWaiter(autoscaler, wg),
+		wg:                wg,
 	}
 }
 
@@ -49,7 +156,7 @@ func (p Proxy) acceptIncoming(ctx context.Context, addr string, c chan newConnec
 	log := log.WithField("addr", addr)
 	log.Debug("Setting up listener at addr")
 
-	l, err := (&net.ListenConfig{}).Listen(ctx, "tcp", addr)
+	l, err := listen(ctx, addr, p.listenAddr[addr].Listen)
 	if err != nil {
 		log.WithError(err).Error("Error listening to addr")
 		return
@@ -68,43 +175,92 @@ func (p Proxy) acceptIncoming(ctx context.Context, addr string, c chan newConnec
 			log.WithError(err).Error("Error accepting incoming request")
 			return
 		}
+		// Behind a load balancer the address of the client is in the PROXY header, checked
+		// against the acl in handshake. Only trusted load balancers can send it
+		if p.listenAddr[addr].Listen.ProxyProtocol {
+			if !p.proxyProtocolFrom[addr].allowed(conn.RemoteAddr()) {
+				log.WithField("remote_addr", conn.RemoteAddr().String()).Warn("PROXY header from untrusted address, rejecting")
+				metrics.ConnectionsRejected.WithLabelValues(addr).Inc()
+				conn.Close()
+				continue
+			}
+		} else if !p.acls[addr].allowed(conn.RemoteAddr()) {
+			log.WithField("remote_addr", conn.RemoteAddr().String()).Warn("Client not allowed by acl, rejecting")
+			metrics.ConnectionsRejected.WithLabelValues(addr).Inc()
+			conn.Close()
+			continue
+		}
 		log.WithField("remote_addr", conn.RemoteAddr().String()).Debug("Accepted request")
+		metrics.ConnectionsAccepted.WithLabelValues(addr).Inc()
+
+		// The handshake has to happen without blocking other connections
+		if p.listenAddr[addr].Listen.needsHandshake() {
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.handshake(ctx, addr, conn, c)
+			}()
+			continue
+		}
+
 		c <- newConnectionCallback{
-			addr: addr,
-			conn: conn,
+			addr:     addr,
+			conn:     conn,
+			upstream: p.listenAddr[addr].UpstreamOpts,
 		}
 	}
 }
 
-// Takes an incoming connection and the addr it came at, gets the appropriate connection from
-// the autoscaler based on addr, and "connects" the two.
-func (p Proxy) handleRequest(ctx context.Context, c net.Conn, addr string) {
+// Takes an incoming connection, gets the connection to its upstream from the autoscaler,
+// and "connects" the two.
+func (p Proxy) handleRequest(ctx context.Context, cb newConnectionCallback) {
+	c, addr := cb.conn, cb.addr
 	log := log.WithField("remote_addr", c.RemoteAddr().String())
 	log.Debug("Handling request")
 
-	// Route the connection based on which addr it came from
-	upstreamOpts := p.listenAddr[addr]
+	atomic.AddInt64(p.connections[addr], 1)
+	defer atomic.AddInt64(p.connections[addr], -1)
 
 	ctx2, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	defer c.Close()
 
-	upstream, err := p.as.GetConnection(ctx2, upstreamOpts)
+	upstream, err := p.as.GetConnection(ctx2, cb.upstream)
+	if cb.connected != nil {
+		if cerr := cb.connected(err); cerr != nil && err == nil {
+			upstream.Close()
+			return
+		}
+	}
 	if err != nil {
 		log.WithError(err).Error("Failed to connect to autoscaler upstream")
 		return
 	}
 	defer upstream.Close()
 
+	if version := p.listenAddr[addr].ProxyProtocol; version != "" {
+		if err := writeProxyHeader(upstream, version, c.RemoteAddr(), c.LocalAddr()); err != nil {
+			log.WithError(err).Error("Failed to send PROXY header to upstream")
+			return
+		}
+	}
+
 	stop := make(chan struct{}, 2)
 
+	upstreamBytes := metrics.BytesCopied.WithLabelValues(addr, "upstream")
+	downstreamBytes := metrics.BytesCopied.WithLabelValues(addr, "downstream")
+
 	go func() {
-		io.Copy(upstream, c)
+		io.Copy(utils.NewCountingWriter(upstream, func(n int) {
+			upstreamBytes.Add(float64(n))
+		}), c)
 		stop <- struct{}{}
 	}()
 	go func() {
-		io.Copy(c, upstream)
+		io.Copy(utils.NewCountingWriter(c, func(n int) {
+			downstreamBytes.Add(float64(n))
+		}), upstream)
 		stop <- struct{}{}
 	}()
 
@@ -135,27 +291,53 @@ func (p Proxy) Start(ctx context.Context) error {
 		p.wg.Add(1)
 		go func() {
 			defer p.wg.Done()
+			if p.listenAddr[addr].Listen.network() == "udp" {
+				p.serveUDP(ctx, addr)
+				return
+			}
 			p.acceptIncoming(ctx, addr, newConns)
 		}()
 	}
 
+	for addr := range p.httpListeners {
+		addr := addr
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.serveHTTP(ctx, addr)
+		}()
+	}
+
+	if p.adminAddr != "" {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.serveAdmin(ctx)
+		}()
+	}
+
 	p.procs.Run(ctx)
 
 LOOP:
 	for {
 		select {
 		case c := <-newConns:
-			if err := p.as.EnsureOnline(ctx); err != nil {
-				c.conn.Close()
-				log.WithField("remote_addr", c.conn.RemoteAddr().String()).WithError(err).Error("Autoscaler ensure online failed")
-				continue LOOP
-			}
-
-			// Keep track of the goroutine that handles the connection
+			// Keep track of the goroutine that handles the connection. Connections wait for
+			// the server in their own goroutine, so they don't hold up each other
 			p.wg.Add(1)
 			go func() {
 				defer p.wg.Done()
-				p.handleRequest(ctx, c.conn, c.addr)
+
+				if err := p.waitForOnline(ctx, p.listenAddr[c.addr].Listen.waitTimeout()); err != nil {
+					if c.connected != nil {
+						c.connected(err)
+					}
+					c.conn.Close()
+					log.WithField("remote_addr", c.conn.RemoteAddr().String()).WithError(err).Error("Autoscaler ensure online failed")
+					return
+				}
+
+				p.handleRequest(ctx, c)
 			}()
 			break
 		case <-ctx.Done():
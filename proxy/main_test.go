@@ -0,0 +1,391 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	as "github.com/JonasBak/autoscaler-proxy/autoscaler"
+	"github.com/JonasBak/autoscaler-proxy/internal/fakeprovider"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	// Speeds up key generation, the key size is irrelevant for the tests
+	as.RSA_KEY_BITS = 2048
+}
+
+// Runs a proxy backed by the fake provider, listening on a local port and forwarding
+// to an echo server.
+type harness struct {
+	t        *testing.T
+	provider *fakeprovider.Provider
+	proxy    Proxy
+	network  string
+	addr     string
+}
+
+func testAutoscalerOpts() as.AutoscalerOpts {
+	return as.AutoscalerOpts{
+		ConnectionTimeout: time.Minute,
+		ScaledownAfter:    time.Minute,
+		ServerNamePrefix:  "test",
+		CloudInitTemplate: map[string]interface{}{
+			"ssh_keys": map[string]string{
+				"rsa_private": "${SERVER_RSA_PRIVATE}",
+				"rsa_public":  "${SERVER_RSA_PUBLIC}",
+			},
+			"users": []interface{}{
+				"default",
+				map[string]interface{}{
+					"name":                "autoscaler",
+					"ssh_authorized_keys": []string{"${AUTOSCALER_AUTHORIZED_KEY}"},
+				},
+			},
+		},
+	}
+}
+
+// Uses the listener in opts.ListenAddr if there is one, otherwise a tcp listener forwarding
+// to an echo server.
+func newHarness(t *testing.T, opts ProxyOpts) *harness {
+	provider := fakeprovider.New()
+
+	if opts.ListenAddr == nil {
+		opts.ListenAddr = map[string]ListenOpts{
+			freeAddr(t): {UpstreamOpts: as.UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)}},
+		}
+	}
+	var addr, network string
+	for a, listenOpts := range opts.ListenAddr {
+		addr, network = a, listenOpts.Listen.network()
+	}
+
+	p := NewWithAutoscaler(opts, as.NewWithProvider(opts.Autoscaler, provider))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go p.Start(ctx)
+
+	t.Cleanup(func() {
+		cancel()
+		p.Stop()
+		if n := provider.Running(); n != 0 {
+			t.Errorf("Expected all servers to be deleted on stop, %d still running", n)
+		}
+	})
+
+	return &harness{
+		t:        t,
+		provider: provider,
+		proxy:    p,
+		network:  network,
+		addr:     addr,
+	}
+}
+
+// Connects to the proxy, retrying while the listener is starting up
+func (h *harness) dial() net.Conn {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial(h.network, h.addr)
+		if err == nil {
+			h.t.Cleanup(func() { conn.Close() })
+			return conn
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (h *harness) waitForRunning(n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for h.provider.Running() != n {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("Expected %d servers running, got %d", n, h.provider.Running())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func startEchoServer(t *testing.T) string {
+	return startEchoServerAt(t, "127.0.0.1:0")
+}
+
+func startEchoServerAt(t *testing.T, addr string) string {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func assertEcho(t *testing.T, rw io.ReadWriter, msg string) {
+	if _, err := rw.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("Expected '%s', got '%s'", msg, buf)
+	}
+}
+
+func TestScaleUpOnFirstConnection(t *testing.T) {
+	h := newHarness(t, ProxyOpts{Autoscaler: testAutoscalerOpts()})
+
+	if n := h.provider.Running(); n != 0 {
+		t.Fatalf("Expected no servers before first connection, got %d", n)
+	}
+
+	conn := h.dial()
+	assertEcho(t, conn, "hello")
+	h.waitForRunning(1)
+
+	conn2 := h.dial()
+	assertEcho(t, conn2, "world")
+	assertEcho(t, conn, "again")
+	h.waitForRunning(1)
+}
+
+func TestScaledownAfterIdle(t *testing.T) {
+	opts := testAutoscalerOpts()
+	opts.ScaledownAfter = 200 * time.Millisecond
+	opts.ScaledownInterval = 20 * time.Millisecond
+	h := newHarness(t, ProxyOpts{Autoscaler: opts})
+
+	conn := h.dial()
+	assertEcho(t, conn, "hello")
+	conn.Close()
+
+	h.waitForRunning(0)
+
+	conn = h.dial()
+	assertEcho(t, conn, "scaled up again")
+	h.waitForRunning(1)
+}
+
+func TestMinServersCreatedOnStart(t *testing.T) {
+	opts := testAutoscalerOpts()
+	opts.MinServers = 1
+	h := newHarness(t, ProxyOpts{Autoscaler: opts})
+
+	h.waitForRunning(1)
+
+	conn := h.dial()
+	assertEcho(t, conn, "hello")
+	h.waitForRunning(1)
+}
+
+func TestBusyWhileTrafficFlows(t *testing.T) {
+	opts := testAutoscalerOpts()
+	opts.ConnectionTimeout = 150 * time.Millisecond
+	opts.ScaledownAfter = 100 * time.Millisecond
+	opts.ScaledownInterval = 20 * time.Millisecond
+	h := newHarness(t, ProxyOpts{Autoscaler: opts})
+
+	conn := h.dial()
+	for i := 0; i < 12; i++ {
+		assertEcho(t, conn, "still working")
+		time.Sleep(50 * time.Millisecond)
+	}
+	h.waitForRunning(1)
+
+	// Without traffic the connection is closed, and then the server is scaled down
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected idle connection to be closed, got %v", err)
+	}
+	h.waitForRunning(0)
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "docker.sock")
+	h := newHarness(t, ProxyOpts{
+		Autoscaler: testAutoscalerOpts(),
+		ListenAddr: map[string]ListenOpts{
+			path: {
+				UpstreamOpts: as.UpstreamOpts{Net: "tcp", Addr: startEchoServer(t)},
+				Listen:       ListenerOpts{Net: "unix", Mode: 0600},
+			},
+		},
+	})
+
+	conn := h.dial()
+	assertEcho(t, conn, "hello")
+	h.waitForRunning(1)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("Expected socket mode 0600, got %o", mode)
+	}
+}
+
+func TestListenOptsFromYaml(t *testing.T) {
+	opts := ProxyOpts{}
+	err := yaml.Unmarshal([]byte(`
+listen_addr:
+  /run/autoscaler/docker.sock:
+    net: unix
+    addr: /var/run/docker.sock
+    listen:
+      net: unix
+      mode: 0660
+      owner: root:docker
+`), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := opts.ListenAddr["/run/autoscaler/docker.sock"]
+	if l.Net != "unix" || l.Addr != "/var/run/docker.sock" {
+		t.Errorf("Unexpected upstream %+v", l.UpstreamOpts)
+	}
+	if l.Listen.Net != "unix" || l.Listen.Mode != 0660 || l.Listen.Owner != "root:docker" {
+		t.Errorf("Unexpected listener %+v", l.Listen)
+	}
+}
+
+func startUDPEchoServer(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func TestUDPForwarding(t *testing.T) {
+	opts := testAutoscalerOpts()
+	opts.ScaledownAfter = 200 * time.Millisecond
+	opts.ScaledownInterval = 20 * time.Millisecond
+	addr := freeAddr(t)
+	h := newHarness(t, ProxyOpts{
+		Autoscaler: opts,
+		ListenAddr: map[string]ListenOpts{
+			addr: {
+				UpstreamOpts: as.UpstreamOpts{Net: "udp", Addr: startUDPEchoServer(t)},
+				Listen:       ListenerOpts{Net: "udp", UDPIdleTimeout: time.Second},
+			},
+		},
+	})
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Datagrams sent before the listener is up, or before the flow is ready, can be lost
+	exchange := func(msg string) {
+		buf := make([]byte, 1024)
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			conn.Write([]byte(msg))
+			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			n, err := conn.Read(buf)
+			if err == nil {
+				if string(buf[:n]) != msg {
+					t.Fatalf("Expected '%s', got '%s'", msg, buf[:n])
+				}
+				return
+			}
+		}
+		t.Fatalf("No reply to '%s'", msg)
+	}
+
+	exchange("hello")
+	h.waitForRunning(1)
+	exchange("world")
+
+	// The flow expires when idle, and then the server is scaled down
+	h.waitForRunning(0)
+	exchange("again")
+	h.waitForRunning(1)
+}
+
+func TestConnectionsWaitForServerConcurrently(t *testing.T) {
+	// The server isn't ready until the upstream is started
+	upstream := freeAddr(t)
+	autoscalerOpts := testAutoscalerOpts()
+	autoscalerOpts.Readiness = []as.ProbeOpts{
+		{Type: "tcp", Addr: upstream, Retries: 200, Backoff: 50 * time.Millisecond},
+	}
+
+	h := newHarness(t, ProxyOpts{
+		Autoscaler: autoscalerOpts,
+		ListenAddr: map[string]ListenOpts{
+			freeAddr(t): {
+				UpstreamOpts: as.UpstreamOpts{Net: "tcp", Addr: upstream},
+				Listen:       ListenerOpts{WaitTimeout: 500 * time.Millisecond},
+			},
+		},
+	})
+
+	impatient := h.dial()
+	impatient.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := impatient.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected connection to be closed after the wait timeout, got %v", err)
+	}
+	if n := h.provider.Running(); n != 1 {
+		t.Fatalf("Expected server to still be created after the wait timeout, got %d", n)
+	}
+
+	conns := []net.Conn{h.dial(), h.dial(), h.dial()}
+	startEchoServerAt(t, upstream)
+
+	for i, conn := range conns {
+		assertEcho(t, conn, fmt.Sprintf("hello %d", i))
+	}
+
+	if n := h.provider.Running(); n != 1 {
+		t.Fatalf("Expected the connections to share one server, got %d", n)
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	as "github.com/JonasBak/autoscaler-proxy/autoscaler"
+)
+
+// Makes sure a server is online in the background, sharing one EnsureOnline between
+// everyone waiting at the same time.
+type onlineWaiter struct {
+	as *as.Autoscaler
+	// The proxy waits for the background EnsureOnline before shutting down the autoscaler
+	wg      *sync.WaitGroup
+	mu      sync.Mutex
+	pending *pendingOnline
+}
+
+// An EnsureOnline running in the background, done is closed when it has returned
+type pendingOnline struct {
+	done chan struct{}
+	err  error
+}
+
+func newOnlineWaiter(autoscaler *as.Autoscaler, wg *sync.WaitGroup) *onlineWaiter {
+	return &onlineWaiter{as: autoscaler, wg: wg}
+}
+
+// Starts EnsureOnline in the background, unless it is already running, and returns it
+func (w *onlineWaiter) ensureOnline() *pendingOnline {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.pending != nil {
+		return w.pending
+	}
+
+	pending := &pendingOnline{done: make(chan struct{})}
+	w.pending = pending
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		pending.err = w.as.EnsureOnline(context.Background())
+
+		w.mu.Lock()
+		w.pending = nil
+		w.mu.Unlock()
+
+		close(pending.done)
+	}()
+
+	return pending
+}
+
+// Waits up to timeout for a server to come online, along with everyone else waiting, so a
+// connection doesn't hold up the others while a server is being created.
+func (p Proxy) waitForOnline(ctx context.Context, timeout time.Duration) error {
+	pending := p.online.ensureOnline()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-pending.done:
+		return pending.err
+	case <-timer.C:
+		return fmt.Errorf("Timed out waiting for a server to come online")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol (https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt), used by
+// load balancers to pass on the address of the client.
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest possible v1 header, including CRLF
+const proxyV1MaxLength = 107
+
+// A connection from behind a load balancer, with the addresses from the PROXY header
+type proxyProtocolConn struct {
+	bufferedConn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c proxyProtocolConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// Reads the PROXY header (v1 or v2) at the start of conn, returning a connection with the
+// addresses from the header. The addresses of conn are kept if the header doesn't have any,
+// like for health checks from the load balancer.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	result := proxyProtocolConn{
+		bufferedConn: bufferedConn{Conn: conn, r: r},
+		remote:       conn.RemoteAddr(),
+		local:        conn.LocalAddr(),
+	}
+
+	signature, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var src, dst net.Addr
+	if bytes.Equal(signature, proxyV2Signature) {
+		src, dst, err = readProxyHeaderV2(r)
+	} else if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		src, dst, err = readProxyHeaderV1(r)
+	} else {
+		return nil, fmt.Errorf("Missing PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if src != nil && dst != nil {
+		result.remote, result.local = src, dst
+	}
+
+	return result, nil
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, nil, fmt.Errorf("PROXY v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("Invalid PROXY v1 header")
+	}
+
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+func parseProxyAddr(ip string, port string) (*net.TCPAddr, error) {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return nil, fmt.Errorf("Invalid ip '%s' in PROXY header", ip)
+	}
+	parsedPort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: parsedIP, Port: int(parsedPort)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("Unsupported PROXY version %d", header[12]>>4)
+	}
+	command, family := header[12]&0xf, header[13]
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL, connections from the load balancer itself
+	if command == 0 {
+		return nil, nil, nil
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// Other protocols are accepted, but without addresses
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("PROXY v2 header too short")
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+
+	return src, dst, nil
+}
+
+// Writes a PROXY header of version (v1 or v2) to w, for a connection from src to dst.
+// Addresses that aren't tcp, like for unix sockets, are sent as unknown.
+func writeProxyHeader(w io.Writer, version string, src net.Addr, dst net.Addr) error {
+	srcTCP, srcOk := src.(*net.TCPAddr)
+	dstTCP, dstOk := dst.(*net.TCPAddr)
+	known := srcOk && dstOk
+
+	ipv4 := known && srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil
+
+	switch version {
+	case "v1":
+		header := "PROXY UNKNOWN\r\n"
+		if known {
+			family := "TCP6"
+			if ipv4 {
+				family = "TCP4"
+			}
+			header = fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcTCP.IP, dstTCP.IP, srcTCP.Port, dstTCP.Port)
+		}
+		_, err := io.WriteString(w, header)
+		return err
+	case "v2":
+		header := append([]byte{}, proxyV2Signature...)
+		var payload []byte
+		switch {
+		case ipv4:
+			header = append(header, 0x21, 0x11)
+			payload = append(payload, srcTCP.IP.To4()...)
+			payload = append(payload, dstTCP.IP.To4()...)
+		case known:
+			header = append(header, 0x21, 0x21)
+			payload = append(payload, srcTCP.IP.To16()...)
+			payload = append(payload, dstTCP.IP.To16()...)
+		default:
+			header = append(header, 0x21, 0x00)
+		}
+		if known {
+			payload = binary.BigEndian.AppendUint16(payload, uint16(srcTCP.Port))
+			payload = binary.BigEndian.AppendUint16(payload, uint16(dstTCP.Port))
+		}
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+		_, err := w.Write(append(header, payload...))
+		return err
+	default:
+		return fmt.Errorf("Unknown PROXY protocol version '%s'", version)
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	as "github.com/JonasBak/autoscaler-proxy/autoscaler"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	for _, version := range []string{"v1", "v2"} {
+		for _, tc := range []struct {
+			src net.Addr
+			dst net.Addr
+		}{
+			{&net.TCPAddr{IP: net.ParseIP("192.0.2.10").To4(), Port: 5555}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 443}},
+			{&net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 5555}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}},
+			{&net.UnixAddr{Name: "@", Net: "unix"}, &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}},
+		} {
+			client, server := net.Pipe()
+			go func() {
+				writeProxyHeader(client, version, tc.src, tc.dst)
+				client.Write([]byte("payload"))
+				client.Close()
+			}()
+
+			conn, err := readProxyHeader(server)
+			if err != nil {
+				t.Fatalf("%s: %v", version, err)
+			}
+
+			expectedSrc, expectedDst := tc.src.String(), tc.dst.String()
+			if _, ok := tc.src.(*net.UnixAddr); ok {
+				// Unknown addresses fall back to the addresses of the connection
+				expectedSrc, expectedDst = server.RemoteAddr().String(), server.LocalAddr().String()
+			}
+			if conn.RemoteAddr().String() != expectedSrc || conn.LocalAddr().String() != expectedDst {
+				t.Errorf("%s: expected %s -> %s, got %s -> %s", version, expectedSrc, expectedDst, conn.RemoteAddr(), conn.LocalAddr())
+			}
+
+			rest, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != "payload" {
+				t.Errorf("%s: expected data after the header to be kept, got '%s'", version, rest)
+			}
+		}
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		client.Close()
+	}()
+	if _, err := readProxyHeader(server); err == nil {
+		t.Error("Expected connection without header to fail")
+	}
+}
+
+// Starts an upstream reading the PROXY header of every connection, and answering with the
+// address of the client in it.
+func startProxyProtocolServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				proxyConn, err := readProxyHeader(conn)
+				if err != nil {
+					return
+				}
+				proxyConn.Write([]byte(proxyConn.RemoteAddr().String() + "\n"))
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestProxyProtocolEndToEnd(t *testing.T) {
+	addr := freeAddr(t)
+	h := newHarness(t, ProxyOpts{
+		Autoscaler: testAutoscalerOpts(),
+		ListenAddr: map[string]ListenOpts{
+			addr: {
+				UpstreamOpts:  as.UpstreamOpts{Net: "tcp", Addr: startProxyProtocolServer(t)},
+				ProxyProtocol: "v2",
+				Listen: ListenerOpts{
+					ProxyProtocol:     true,
+					ProxyProtocolFrom: []string{"127.0.0.1"},
+					ACL:               ACLOpts{Allow: []string{"192.0.2.0/24"}},
+				},
+			},
+		},
+	})
+
+	// The acl applies to the client in the header, not the load balancer
+	conn := h.dial()
+	conn.Write([]byte("PROXY TCP4 198.51.100.1 127.0.0.1 5555 80\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected denied client to be closed, got %v", err)
+	}
+	if n := h.provider.Running(); n != 0 {
+		t.Fatalf("Expected no servers for a rejected client, got %d", n)
+	}
+
+	conn = h.dial()
+	conn.Write([]byte("PROXY TCP4 192.0.2.10 127.0.0.1 5555 80\r\n"))
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(line, []byte("192.0.2.10:5555\n")) {
+		t.Fatalf("Expected upstream to see the client from the header, got '%s'", line)
+	}
+}
+
+func TestForgedProxyHeaderRejected(t *testing.T) {
+	addr := freeAddr(t)
+	h := newHarness(t, ProxyOpts{
+		Autoscaler: testAutoscalerOpts(),
+		ListenAddr: map[string]ListenOpts{
+			addr: {
+				UpstreamOpts: as.UpstreamOpts{Net: "tcp", Addr: startProxyProtocolServer(t)},
+				Listen: ListenerOpts{
+					ProxyProtocol:     true,
+					ProxyProtocolFrom: []string{"10.0.0.0/8"},
+					ACL:               ACLOpts{Allow: []string{"192.0.2.0/24"}},
+				},
+			},
+		},
+	})
+
+	// The client isn't a trusted load balancer, so the allowed address in the header is ignored
+	conn := h.dial()
+	conn.Write([]byte("PROXY TCP4 192.0.2.10 127.0.0.1 5555 80\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected forged PROXY header to be rejected")
+	}
+	if n := h.provider.Running(); n != 0 {
+		t.Fatalf("Expected no servers for a forged PROXY header, got %d", n)
+	}
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JonasBak/autoscaler-proxy/metrics"
+)
+
+// Datagrams waiting to be forwarded per flow, more are dropped
+const udpFlowQueue = 64
+
+// The datagrams from one client address, forwarded over their own upstream connection.
+type udpFlow struct {
+	src   net.Addr
+	queue chan []byte
+	// Unix nanos of the last datagram in either direction
+	lastActivity int64
+}
+
+func (f *udpFlow) touch() {
+	atomic.StoreInt64(&f.lastActivity, time.Now().UnixNano())
+}
+
+func (f *udpFlow) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&f.lastActivity)))
+}
+
+// Receives datagrams at addr, and forwards them per client address. The first datagram from
+// a client starts a flow, which scales up if needed, and the flow is closed when no
+// datagrams have been sent either way for the idle timeout of the listener.
+func (p Proxy) serveUDP(ctx context.Context, addr string) {
+	log := log.WithField("addr", addr)
+	log.Debug("Setting up udp listener at addr")
+
+	pc, err := (&net.ListenConfig{}).ListenPacket(ctx, "udp", addr)
+	if err != nil {
+		log.WithError(err).Error("Error listening to addr")
+		return
+	}
+	defer pc.Close()
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	log.Info("Listening at addr")
+
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+
+	buf := make([]byte, 65535)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.WithError(err).Error("Error reading datagram")
+			return
+		}
+		datagram := append([]byte{}, buf[:n]...)
+
+		mu.Lock()
+		flow, ok := flows[src.String()]
+		if !ok && !p.acls[addr].allowed(src) {
+			mu.Unlock()
+			log.WithField("remote_addr", src.String()).Warn("Client not allowed by acl, dropping datagram")
+			metrics.ConnectionsRejected.WithLabelValues(addr).Inc()
+			continue
+		}
+		if !ok {
+			log.WithField("remote_addr", src.String()).Debug("New udp flow")
+			metrics.ConnectionsAccepted.WithLabelValues(addr).Inc()
+
+			flow = &udpFlow{src: src, queue: make(chan []byte, udpFlowQueue)}
+			flow.touch()
+			flows[src.String()] = flow
+
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.handleUDPFlow(ctx, pc, addr, flow)
+
+				mu.Lock()
+				delete(flows, flow.src.String())
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		select {
+		case flow.queue <- datagram:
+		default:
+			log.WithField("remote_addr", src.String()).Debug("Udp flow queue full, dropping datagram")
+		}
+	}
+}
+
+// Forwards the datagrams of flow until it has been idle for the idle timeout
+func (p Proxy) handleUDPFlow(ctx context.Context, pc net.PacketConn, addr string, flow *udpFlow) {
+	log := log.WithField("remote_addr", flow.src.String())
+
+	atomic.AddInt64(p.connections[addr], 1)
+	defer atomic.AddInt64(p.connections[addr], -1)
+
+	if err := p.waitForOnline(ctx, p.listenAddr[addr].Listen.waitTimeout()); err != nil {
+		log.WithError(err).Error("Autoscaler ensure online failed")
+		return
+	}
+
+	ctx2, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	upstream, err := p.as.GetConnection(ctx2, p.listenAddr[addr].UpstreamOpts)
+	if err != nil {
+		log.WithError(err).Error("Failed to connect to autoscaler upstream")
+		return
+	}
+	defer upstream.Close()
+
+	upstreamBytes := metrics.BytesCopied.WithLabelValues(addr, "upstream")
+	downstreamBytes := metrics.BytesCopied.WithLabelValues(addr, "downstream")
+
+	stop := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				if err != io.EOF {
+					log.WithError(err).Debug("Error reading from udp upstream")
+				}
+				stop <- struct{}{}
+				return
+			}
+			flow.touch()
+			if _, err := pc.WriteTo(buf[:n], flow.src); err == nil {
+				downstreamBytes.Add(float64(n))
+			}
+		}
+	}()
+
+	idleTimeout := p.listenAddr[addr].Listen.udpIdleTimeout()
+	timer := time.NewTimer(idleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case datagram := <-flow.queue:
+			flow.touch()
+			if _, err := upstream.Write(datagram); err != nil {
+				log.WithError(err).Debug("Error writing to udp upstream")
+				return
+			}
+			upstreamBytes.Add(float64(len(datagram)))
+		case <-timer.C:
+			idle := flow.idle()
+			if idle < idleTimeout {
+				timer.Reset(idleTimeout - idle)
+				continue
+			}
+			log.Debug("Udp flow idle, closing")
+			return
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -31,3 +31,19 @@ func (rwc ReadWriteCloseNotifier) Close() error {
 	rwc.c <- struct{}{}
 	return rwc.rwc.Close()
 }
+
+type countingWriter struct {
+	w     io.Writer
+	count func(n int)
+}
+
+// Wraps w, calling count with the number of bytes written on every write.
+func NewCountingWriter(w io.Writer, count func(n int)) io.Writer {
+	return countingWriter{w: w, count: count}
+}
+
+func (w countingWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	w.count(n)
+	return n, err
+}
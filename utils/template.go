@@ -24,28 +24,41 @@ func buildTemplateString(templateFunc TemplateFunc, v string) string {
 }
 
 func buildTemplateValue(templateFunc TemplateFunc, v interface{}) interface{} {
+	if v == nil {
+		return v
+	}
 	ty := reflect.TypeOf(v).Kind()
 	if ty == reflect.String {
 		return buildTemplateString(templateFunc, v.(string))
 	} else if ty == reflect.Slice {
 		s := reflect.ValueOf(v)
+		s2 := reflect.MakeSlice(s.Type(), s.Len(), s.Len())
 		for i := 0; i < s.Len(); i++ {
 			templated := buildTemplateValue(templateFunc, s.Index(i).Interface())
-			s.Index(i).Set(reflect.ValueOf(templated))
+			if templated != nil {
+				s2.Index(i).Set(reflect.ValueOf(templated))
+			}
 		}
-		return v
+		return s2.Interface()
 	} else if ty == reflect.Map {
-		v2 := v
-		iter := reflect.ValueOf(v).MapRange()
+		m := reflect.ValueOf(v)
+		m2 := reflect.MakeMapWithSize(m.Type(), m.Len())
+		iter := m.MapRange()
 		for iter.Next() {
 			templated := buildTemplateValue(templateFunc, iter.Value().Interface())
-			reflect.ValueOf(v2).SetMapIndex(iter.Key(), reflect.ValueOf(templated))
+			if templated == nil {
+				m2.SetMapIndex(iter.Key(), iter.Value())
+				continue
+			}
+			m2.SetMapIndex(iter.Key(), reflect.ValueOf(templated))
 		}
-		return v2
+		return m2.Interface()
 	}
 	return v
 }
 
+// Returns a copy of template with the variables replaced, template itself isn't modified, so
+// it can be built again with other values.
 func BuildTemplate(templateFunc TemplateFunc, template interface{}) interface{} {
 	config := buildTemplateValue(templateFunc, template)
 
@@ -119,3 +119,16 @@ func TestNestedListMap(t *testing.T) {
 	assertEq(t, result["upper_b"][1]["lower_a"], replace["ABC"])
 	assertEq(t, result["upper_b"][1]["lower_b"], replace["DEF"])
 }
+
+func TestTemplateNotModified(t *testing.T) {
+	config := map[string][]string{
+		"list": {"${ABC}"},
+	}
+
+	first := BuildTemplate(TemplateMap(map[string]string{"ABC": "123"}), config).(map[string][]string)
+	second := BuildTemplate(TemplateMap(map[string]string{"ABC": "456"}), config).(map[string][]string)
+
+	assertEq(t, first["list"][0], "123")
+	assertEq(t, second["list"][0], "456")
+	assertEq(t, config["list"][0], "${ABC}")
+}